@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+
+	"github.com/c-14/grue/config"
+	"github.com/mmcdole/gofeed"
+	"gopkg.in/gomail.v2"
+)
+
+// parseAddress parses an address in any of the forms found in feeds, like
+// "jane@example.net", "Jane <jane@example.net>" or "jane@example.net (Jane)".
+// Addresses which can't be sent to without SMTPUTF8 are rejected.
+func parseAddress(s string) (*mail.Address, error) {
+	addr, err := mail.ParseAddress(s)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range addr.Address {
+		if c < '!' || c > '~' {
+			return nil, fmt.Errorf("mail: non-ASCII address %q", addr.Address)
+		}
+	}
+	return addr, nil
+}
+
+// itemAuthor returns the name and, if it is valid, the address of the
+// author of item, or else of feed. Items without an author fall back to
+// the first of their authors, as in JSON Feed 1.1, and to their dc:creator,
+// which gofeed only translates for RSS.
+func itemAuthor(feed *gofeed.Feed, item *gofeed.Item, log *Logger) (string, string) {
+	var author gofeed.Person
+	if item.Author != nil {
+		author = *item.Author
+	} else if len(item.Authors) > 0 && item.Authors[0] != nil {
+		author = *item.Authors[0]
+	} else if creator := dcValues(item, "creator"); len(creator) > 0 {
+		if addr, err := mail.ParseAddress(creator[0]); err == nil {
+			author = gofeed.Person{Name: addr.Name, Email: addr.Address}
+		} else {
+			author.Name = creator[0]
+		}
+	} else if feed.Author != nil {
+		author = *feed.Author
+	}
+	if author.Email == "" {
+		return author.Name, ""
+	}
+	addr, err := parseAddress(author.Email)
+	if err != nil {
+		log.Debug("ignoring invalid author address", "address", author.Email, "error", err)
+		return author.Name, ""
+	}
+	if author.Name == "" {
+		author.Name = addr.Name
+	}
+	return author.Name, addr.Address
+}
+
+// formatAddressList formats the addresses in list for an address header of
+// m. Invalid addresses are dropped.
+func formatAddressList(m *gomail.Message, list string) []string {
+	addrs, err := mail.ParseAddressList(list)
+	if err != nil {
+		return nil
+	}
+	var formatted []string
+	for _, addr := range addrs {
+		formatted = append(formatted, m.FormatAddress(addr.Address, addr.Name))
+	}
+	return formatted
+}
+
+// formatAddresses formats the configured addresses addrs for an address
+// header of m, encoding the names as needed.
+func formatAddresses(m *gomail.Message, addrs []string) []string {
+	formatted := make([]string, len(addrs))
+	for i, s := range addrs {
+		// Validate has checked the addresses with {name} replaced for
+		// every account, but keep anything unparsable as it is
+		addr, err := mail.ParseAddress(s)
+		if err != nil {
+			formatted[i] = s
+			continue
+		}
+		formatted[i] = m.FormatAddress(addr.Address, addr.Name)
+	}
+	return formatted
+}
+
+// fromPolicy returns the FromPolicy for an account.
+func fromPolicy(account config.AccountConfig, conf *config.GrueConfig) string {
+	switch {
+	case account.FromPolicy != nil && *account.FromPolicy != "":
+		return *account.FromPolicy
+	case conf.FromPolicy != nil && *conf.FromPolicy != "":
+		return *conf.FromPolicy
+	}
+	return config.FromAuthor
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/c-14/grue/config"
+	"github.com/mmcdole/gofeed"
+)
+
+func TestParseAddress(t *testing.T) {
+	for _, tc := range []struct {
+		in, name, address string
+	}{
+		{"jane@example.net", "", "jane@example.net"},
+		{"Jane Doe <jane@example.net>", "Jane Doe", "jane@example.net"},
+		{"noreply@blogger.com (John)", "John", "noreply@blogger.com"},
+		{"=?utf-8?q?J=C3=BCrgen?= <j@example.net>", "Jürgen", "j@example.net"},
+	} {
+		addr, err := parseAddress(tc.in)
+		if err != nil {
+			t.Errorf("parseAddress(%q): %v", tc.in, err)
+		} else if addr.Name != tc.name || addr.Address != tc.address {
+			t.Errorf("parseAddress(%q) = %q <%s>, want %q <%s>", tc.in, addr.Name, addr.Address, tc.name, tc.address)
+		}
+	}
+	for _, in := range []string{"", "John", "jürgen@example.net", "<@example.net>"} {
+		if addr, err := parseAddress(in); err == nil {
+			t.Errorf("parseAddress(%q) = %v, want error", in, addr)
+		}
+	}
+}
+
+func TestItemAuthor(t *testing.T) {
+	feedAuthor := &gofeed.Person{Name: "Feed Author", Email: "feed@example.net"}
+	for _, tc := range []struct {
+		desc          string
+		item          *gofeed.Item
+		feedAuthor    *gofeed.Person
+		name, address string
+	}{
+		{"author", &gofeed.Item{Author: &gofeed.Person{Name: "Jane", Email: "jane@example.net"}}, feedAuthor, "Jane", "jane@example.net"},
+		{"name in address", &gofeed.Item{Author: &gofeed.Person{Email: "noreply@blogger.com (John)"}}, nil, "John", "noreply@blogger.com"},
+		{"bare name", &gofeed.Item{Author: &gofeed.Person{Name: "John"}}, feedAuthor, "John", ""},
+		{"invalid address", &gofeed.Item{Author: &gofeed.Person{Name: "John", Email: "john at example"}}, nil, "John", ""},
+		{"authors", &gofeed.Item{Authors: []*gofeed.Person{{Name: "First"}, {Name: "Second"}}}, nil, "First", ""},
+		{"feed author", &gofeed.Item{}, feedAuthor, "Feed Author", "feed@example.net"},
+		{"missing", &gofeed.Item{}, nil, "", ""},
+	} {
+		feed := &gofeed.Feed{Author: tc.feedAuthor}
+		name, address := itemAuthor(feed, tc.item, logger)
+		if name != tc.name || address != tc.address {
+			t.Errorf("%s: itemAuthor() = %q, %q, want %q, %q", tc.desc, name, address, tc.name, tc.address)
+		}
+	}
+}
+
+func TestSetFrom(t *testing.T) {
+	author, fixed := config.FromAuthor, config.FromFixed
+	conf := &config.GrueConfig{FromAddress: "grue@example.net", NameFormat: "{author}"}
+	withAuthor := &gofeed.Item{Author: &gofeed.Person{Email: "noreply@blogger.com (John)"}}
+	for _, tc := range []struct {
+		desc   string
+		item   *gofeed.Item
+		policy *string
+		want   [5]string // FromName, FromAddress, SenderAddress, ReplyTo, ReplyToName
+	}{
+		{"default", withAuthor, nil, [5]string{"John", "noreply@blogger.com", "grue@example.net", "", ""}},
+		{"author", withAuthor, &author, [5]string{"John", "noreply@blogger.com", "grue@example.net", "", ""}},
+		{"fixed", withAuthor, &fixed, [5]string{"John", "grue@example.net", "", "noreply@blogger.com", "John"}},
+		{"no address", &gofeed.Item{Author: &gofeed.Person{Name: "John"}}, &author, [5]string{"John", "grue@example.net", "", "", ""}},
+		{"no author", &gofeed.Item{}, &fixed, [5]string{"blog", "grue@example.net", "", "", ""}},
+	} {
+		email := Email{log: logger}
+		email.setFrom("blog", &gofeed.Feed{}, tc.item, config.AccountConfig{FromPolicy: tc.policy}, conf)
+		got := [5]string{email.FromName, email.FromAddress, email.SenderAddress, email.ReplyTo, email.ReplyToName}
+		if got != tc.want {
+			t.Errorf("%s: setFrom() = %q, want %q", tc.desc, got, tc.want)
+		}
+	}
+}
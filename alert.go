@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"strings"
+	"time"
+
+	"github.com/c-14/grue/config"
+	"gopkg.in/gomail.v2"
+)
+
+// alertsEnabled reports whether conf asks for emails about broken feeds.
+func alertsEnabled(conf *config.GrueConfig) bool {
+	return conf.AlertFailures != nil || conf.AlertAge != nil
+}
+
+// isBroken reports whether account has been failing long enough to warrant
+// an alert, either by number of consecutive failures or by the time since
+// the last successful fetch.
+func isBroken(account *RSSFeed, conf *config.GrueConfig, now time.Time) (bool, error) {
+	if account.Tries == 0 {
+		return false, nil
+	}
+	if conf.AlertFailures != nil && account.Tries >= *conf.AlertFailures {
+		return true, nil
+	}
+	if conf.AlertAge != nil {
+		age, err := config.ParseAge(*conf.AlertAge)
+		if err != nil {
+			return false, fmt.Errorf("AlertAge: %v", err)
+		}
+		since := account.LastFetched
+		if since == 0 {
+			since = account.FailingSince
+		}
+		if since != 0 && now.Sub(time.Unix(since, 0)) >= age {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func alertRecipients(feedName string, conf *config.GrueConfig) []string {
+	if conf.AdminRecipient != nil && *conf.AdminRecipient != "" {
+		return []string{*conf.AdminRecipient}
+	}
+	return expandAddresses(conf.Recipient, feedName)
+}
+
+func createAlertEmail(feedName string, account *RSSFeed, subject string, conf *config.GrueConfig) *Email {
+	email := new(Email)
+	email.log = logger.With("feed", feedName, "uri", account.config.URI)
+	email.FromName = "grue"
+	email.FromAddress = conf.FromAddress
+	email.Recipients = alertRecipients(feedName, conf)
+	email.Subject = subject
+	email.Date = time.Now()
+	email.setUserAgent(conf)
+	email.FeedURL = account.config.URI
+	email.setListId(feedName, account.config.URI, conf)
+
+	lines := []string{
+		"Feed: " + feedName,
+		"URI: " + account.config.URI,
+		"Last success: " + formatTime(account.LastFetched),
+		"Last attempt: " + formatTime(account.LastQueried),
+		fmt.Sprintf("Consecutive failures: %d", account.Tries),
+	}
+	if account.HTTPStatus != 0 {
+		lines = append(lines, fmt.Sprintf("HTTP status: %d", account.HTTPStatus))
+	}
+	if account.LastError != "" {
+		lines = append(lines, "Last error: "+account.LastError)
+	}
+	for i := range lines {
+		lines[i] = html.EscapeString(lines[i])
+	}
+	email.Body = strings.Join(lines, "<br>\n")
+	return email
+}
+
+// checkAlert sends an alert the first time account is found broken and a
+// recovery notice once it has been fetched successfully again.
+func checkAlert(mailer gomail.Sender, feedName string, account *RSSFeed, conf *config.GrueConfig, now time.Time) error {
+	if mailer == nil || !alertsEnabled(conf) {
+		return nil
+	}
+	if account.Tries == 0 {
+		if !account.Alerted {
+			return nil
+		}
+		e := createAlertEmail(feedName, account, fmt.Sprintf("grue: %s recovered", feedName), conf)
+		if err := e.Send(mailer); err != nil {
+			return err
+		}
+		account.Alerted = false
+		return nil
+	}
+	if account.Alerted {
+		return nil
+	}
+	broken, err := isBroken(account, conf, now)
+	if err != nil || !broken {
+		return err
+	}
+	e := createAlertEmail(feedName, account, fmt.Sprintf("grue: %s is failing", feedName), conf)
+	if err := e.Send(mailer); err != nil {
+		return err
+	}
+	account.Alerted = true
+	return nil
+}
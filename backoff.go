@@ -0,0 +1,98 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/c-14/grue/config"
+)
+
+// By default the interval between retries of a failing feed doubles from
+// 30 minutes up to a day.
+const (
+	defaultBackoffBase       = 30 * time.Minute
+	defaultBackoffMultiplier = 2
+	defaultBackoffMax        = 24 * time.Hour
+	defaultBackoffJitter     = 0.1
+)
+
+type backoff struct {
+	base       time.Duration
+	multiplier float64
+	max        time.Duration
+	jitter     float64
+}
+
+// backoffPolicy returns the backoff for an account, where the account's
+// settings take precedence over the global ones. Invalid durations, which
+// Validate reports, are logged and leave the default in place.
+func backoffPolicy(cfg config.AccountConfig, conf *config.GrueConfig, log *Logger) backoff {
+	b := backoff{defaultBackoffBase, defaultBackoffMultiplier, defaultBackoffMax, defaultBackoffJitter}
+	for _, s := range []struct {
+		base       *string
+		multiplier *float64
+		max        *string
+		jitter     *float64
+	}{
+		{conf.BackoffBase, conf.BackoffMultiplier, conf.BackoffMax, conf.BackoffJitter},
+		{cfg.BackoffBase, cfg.BackoffMultiplier, cfg.BackoffMax, cfg.BackoffJitter},
+	} {
+		if s.base != nil {
+			b.base = parseBackoff("BackoffBase", *s.base, b.base, log)
+		}
+		if s.multiplier != nil {
+			b.multiplier = *s.multiplier
+		}
+		if s.max != nil {
+			b.max = parseBackoff("BackoffMax", *s.max, b.max, log)
+		}
+		if s.jitter != nil {
+			b.jitter = *s.jitter
+		}
+	}
+	return b
+}
+
+func parseBackoff(key, value string, def time.Duration, log *Logger) time.Duration {
+	d, err := config.ParseAge(value)
+	if err != nil {
+		log.Error("invalid "+key+", using "+def.String(), "error", err)
+		return def
+	}
+	return d
+}
+
+// pollInterval returns the minimum time between two queries of an account.
+// An invalid Interval is logged and doesn't delay queries.
+func pollInterval(cfg config.AccountConfig, log *Logger) time.Duration {
+	if cfg.Interval == nil {
+		return 0
+	}
+	d, err := config.ParseAge(*cfg.Interval)
+	if err != nil {
+		log.Error("invalid Interval, not limiting queries", "error", err)
+		return 0
+	}
+	return d
+}
+
+// delay returns how long to wait before retrying after the nth consecutive
+// failure, randomly spread by the jitter but never more than the maximum.
+func (b backoff) delay(n int) time.Duration {
+	d := float64(b.base) * math.Pow(b.multiplier, float64(n-1))
+	if b.jitter > 0 {
+		d *= 1 + b.jitter*(2*rand.Float64()-1)
+	}
+	if d > float64(b.max) {
+		d = float64(b.max)
+	}
+	return time.Duration(d)
+}
+
+// transientError reports whether err is likely to go away by itself, like
+// timeouts, network errors and 429 or 5xx responses. Other errors, like
+// 404 responses or unparsable feeds, are considered permanent.
+func transientError(err error) bool {
+	return exitCode(err) == EX_TEMPFAIL
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/c-14/grue/config"
+	"github.com/mmcdole/gofeed"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	b := backoff{base: 30 * time.Minute, multiplier: 2, max: 3 * time.Hour}
+	for n, want := range map[int]time.Duration{
+		1: 30 * time.Minute,
+		2: time.Hour,
+		3: 2 * time.Hour,
+		// Capped at max
+		4:  3 * time.Hour,
+		20: 3 * time.Hour,
+	} {
+		if got := b.delay(n); got != want {
+			t.Errorf("delay(%d) = %v, want %v", n, got, want)
+		}
+	}
+
+	b.jitter = 0.1
+	for i := 0; i < 100; i++ {
+		if d := b.delay(2); d < 54*time.Minute || d > 66*time.Minute {
+			t.Fatalf("delay(2) with jitter 0.1 = %v, want within 10%% of 1h", d)
+		}
+		if d := b.delay(10); d > 3*time.Hour {
+			t.Fatalf("delay(10) with jitter = %v, more than the maximum", d)
+		}
+	}
+}
+
+func TestBackoffPolicy(t *testing.T) {
+	base, max, bad := "1h", "2d", "soon"
+	multiplier := 3.0
+	conf := &config.GrueConfig{BackoffBase: &base, BackoffMax: &bad}
+	cfg := config.AccountConfig{BackoffMultiplier: &multiplier, BackoffMax: &max}
+	want := backoff{time.Hour, 3, 48 * time.Hour, defaultBackoffJitter}
+	if got := backoffPolicy(cfg, conf, logger); got != want {
+		t.Errorf("backoffPolicy() = %+v, want %+v", got, want)
+	}
+	// An invalid duration keeps the default
+	want = backoff{time.Hour, defaultBackoffMultiplier, defaultBackoffMax, defaultBackoffJitter}
+	if got := backoffPolicy(config.AccountConfig{}, conf, logger); got != want {
+		t.Errorf("backoffPolicy() = %+v, want %+v", got, want)
+	}
+}
+
+func TestTransientError(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{gofeed.HTTPError{StatusCode: 429}, true},
+		{gofeed.HTTPError{StatusCode: 503}, true},
+		{gofeed.HTTPError{StatusCode: 404}, false},
+		{gofeed.HTTPError{StatusCode: 410}, false},
+		{&url.Error{Op: "Get", URL: "https://example.net", Err: context.DeadlineExceeded}, true},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{gofeed.ErrFeedTypeNotDetected, false},
+		{errors.New("XML syntax error"), false},
+	} {
+		if got := transientError(tc.err); got != tc.want {
+			t.Errorf("transientError(%v) = %t, want %t", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestPollInterval(t *testing.T) {
+	for _, tc := range []struct {
+		interval string
+		want     time.Duration
+	}{
+		{"6h", 6 * time.Hour},
+		{"1d", 24 * time.Hour},
+		{"daily", 0},
+	} {
+		cfg := config.AccountConfig{Interval: &tc.interval}
+		if got := pollInterval(cfg, logger); got != tc.want {
+			t.Errorf("pollInterval(%q) = %v, want %v", tc.interval, got, tc.want)
+		}
+	}
+	if got := pollInterval(config.AccountConfig{}, logger); got != 0 {
+		t.Errorf("pollInterval() = %v, want 0", got)
+	}
+}
@@ -4,45 +4,183 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/user"
 	"path"
+	"sort"
+	"strings"
 	"text/tabwriter"
 )
 
 type AccountConfig struct {
-	URI        string
-	NameFormat *string `json:",omitempty"`
-	UserAgent  *string `json:",omitempty"`
+	URI               string
+	Tags              []string          `json:",omitempty"`
+	Recipient         *Addresses        `json:",omitempty"`
+	Cc                *Addresses        `json:",omitempty"`
+	Bcc               *Addresses        `json:",omitempty"`
+	Interval          *string           `json:",omitempty"`
+	Headers           map[string]string `json:",omitempty"`
+	FromPolicy        *string           `json:",omitempty"`
+	NameFormat        *string           `json:",omitempty"`
+	UserAgent         *string           `json:",omitempty"`
+	TrackUpdates      *bool             `json:",omitempty"`
+	UpdateDiff        *bool             `json:",omitempty"`
+	BackoffBase       *string           `json:",omitempty"`
+	BackoffMultiplier *float64          `json:",omitempty"`
+	BackoffMax        *string           `json:",omitempty"`
+	BackoffJitter     *float64          `json:",omitempty"`
 }
 
 func (cfg AccountConfig) String() string {
 	var b bytes.Buffer
 	w := tabwriter.NewWriter(&b, 11, 8, 0, '\t', 0)
 	fmt.Fprintf(w, "URI\t\"%s\"\n", cfg.URI)
+	if len(cfg.Tags) > 0 {
+		fmt.Fprintf(w, "Tags\t%s\n", strings.Join(cfg.Tags, ", "))
+	}
+	if cfg.Recipient != nil {
+		fmt.Fprintf(w, "Recipient\t%s\n", strings.Join(*cfg.Recipient, ", "))
+	}
+	if cfg.Cc != nil {
+		fmt.Fprintf(w, "Cc\t%s\n", strings.Join(*cfg.Cc, ", "))
+	}
+	if cfg.Bcc != nil {
+		fmt.Fprintf(w, "Bcc\t%s\n", strings.Join(*cfg.Bcc, ", "))
+	}
+	if cfg.Interval != nil {
+		fmt.Fprintf(w, "Interval\t%s\n", *cfg.Interval)
+	}
+	if cfg.FromPolicy != nil {
+		fmt.Fprintf(w, "From Policy\t%s\n", *cfg.FromPolicy)
+	}
+	var headers []string
+	for name := range cfg.Headers {
+		headers = append(headers, name)
+	}
+	sort.Strings(headers)
+	for _, name := range headers {
+		fmt.Fprintf(w, "Header %s\t\"%s\"\n", name, cfg.Headers[name])
+	}
 	if cfg.NameFormat != nil {
 		fmt.Fprintf(w, "Name Format\t\"%s\"\n", *cfg.NameFormat)
 	}
 	if cfg.UserAgent != nil {
 		fmt.Fprintf(w, "User Agent\t\"%s\"\n", *cfg.UserAgent)
 	}
+	if cfg.TrackUpdates != nil {
+		fmt.Fprintf(w, "Track Updates\t%t\n", *cfg.TrackUpdates)
+	}
+	if cfg.UpdateDiff != nil {
+		fmt.Fprintf(w, "Update Diff\t%t\n", *cfg.UpdateDiff)
+	}
+	if cfg.BackoffBase != nil {
+		fmt.Fprintf(w, "Backoff Base\t%s\n", *cfg.BackoffBase)
+	}
+	if cfg.BackoffMultiplier != nil {
+		fmt.Fprintf(w, "Backoff Multiplier\t%g\n", *cfg.BackoffMultiplier)
+	}
+	if cfg.BackoffMax != nil {
+		fmt.Fprintf(w, "Backoff Max\t%s\n", *cfg.BackoffMax)
+	}
+	if cfg.BackoffJitter != nil {
+		fmt.Fprintf(w, "Backoff Jitter\t%g\n", *cfg.BackoffJitter)
+	}
 	w.Flush()
 	return b.String()
 }
 
+// Addresses is a list of email addresses. In the config file a single
+// address can also be given as a plain string.
+type Addresses []string
+
+func (a *Addresses) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*a = nil
+		if s != "" {
+			*a = Addresses{s}
+		}
+		return nil
+	}
+	var l []string
+	if err := json.Unmarshal(data, &l); err != nil {
+		return err
+	}
+	*a = l
+	return nil
+}
+
+func (a Addresses) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 {
+		return json.Marshal(a[0])
+	}
+	return json.Marshal([]string(a))
+}
+
+// PgpRecipient overrides the global PgpSign and PgpEncrypt settings for
+// one recipient address. Key selects the key to encrypt to by fingerprint,
+// key ID or address, the recipient address is used if it is unset.
+type PgpRecipient struct {
+	Sign    *bool   `json:",omitempty"`
+	Encrypt *bool   `json:",omitempty"`
+	Key     *string `json:",omitempty"`
+}
+
+// ArgError reports an invalid account name or setting given on the command
+// line.
+type ArgError string
+
+func (e ArgError) Error() string {
+	return string(e)
+}
+
+func argErrorf(format string, args ...interface{}) error {
+	return ArgError(fmt.Sprintf(format, args...))
+}
+
 type GrueConfig struct {
-	path         string
-	Recipient    string
-	FromAddress  string
-	NameFormat   string
-	ListIdFormat string
-	UserAgent    string
-	SmtpUser     *string
-	SmtpPass     *string
-	SmtpServer   *string
-	LogLevel     *string
-	Accounts     map[string]AccountConfig
+	path              string
+	raw               []byte
+	locked            bool
+	decodeErr         *ConfigError // from strict decoding, see ReadConfigLenient
+	Recipient         Addresses
+	AdminRecipient    *string `json:",omitempty"`
+	FromAddress       string
+	NameFormat        string
+	ListIdFormat      string
+	UserAgent         string
+	SmtpUser          *string
+	SmtpPass          *string
+	SmtpServer        *string
+	LogLevel          *string
+	LogFormat         *string                  `json:",omitempty"`
+	LogFile           *string                  `json:",omitempty"`
+	MetricsFile       *string                  `json:",omitempty"`
+	AlertFailures     *int                     `json:",omitempty"`
+	AlertAge          *string                  `json:",omitempty"`
+	MovedPolicy       *string                  `json:",omitempty"`
+	FromPolicy        *string                  `json:",omitempty"`
+	DkimDomain        *string                  `json:",omitempty"`
+	DkimSelector      *string                  `json:",omitempty"`
+	DkimKeyFile       *string                  `json:",omitempty"`
+	PgpKeyring        *string                  `json:",omitempty"`
+	PgpSigningKey     *string                  `json:",omitempty"`
+	PgpPassphraseFile *string                  `json:",omitempty"`
+	PgpSign           *bool                    `json:",omitempty"`
+	PgpEncrypt        *bool                    `json:",omitempty"`
+	PgpRecipients     map[string]PgpRecipient  `json:",omitempty"`
+	Concurrency       *int                     `json:",omitempty"`
+	HostConcurrency   *int                     `json:",omitempty"`
+	HostDelay         *string                  `json:",omitempty"`
+	BackoffBase       *string                  `json:",omitempty"`
+	BackoffMultiplier *float64                 `json:",omitempty"`
+	BackoffMax        *string                  `json:",omitempty"`
+	BackoffJitter     *float64                 `json:",omitempty"`
+	Headers           map[string]string        `json:",omitempty"`
+	Groups            map[string]AccountConfig `json:",omitempty"`
+	Accounts          map[string]AccountConfig
 }
 
 func (conf *GrueConfig) Lock() error {
@@ -50,6 +188,7 @@ func (conf *GrueConfig) Lock() error {
 	switch {
 	case err == nil:
 		defer lock.Close()
+		conf.locked = true
 		_, err = lock.WriteString(fmt.Sprint(os.Getpid()))
 		return err
 	case os.IsExist(err):
@@ -59,7 +198,13 @@ func (conf *GrueConfig) Lock() error {
 	}
 }
 
+// Unlock releases the lock taken by Lock. It is safe to call more than
+// once.
 func (conf *GrueConfig) Unlock() error {
+	if !conf.locked {
+		return nil
+	}
+	conf.locked = false
 	return os.Remove(conf.path + ".lock")
 }
 
@@ -84,9 +229,10 @@ func defaultFrom() (string, error) {
 	return from, nil
 }
 
-func (conf *GrueConfig) encode(file *os.File) error {
-	enc := json.NewEncoder(file)
+func (conf *GrueConfig) encode(w io.Writer) error {
+	enc := json.NewEncoder(w)
 	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
 	return enc.Encode(conf)
 }
 
@@ -134,32 +280,87 @@ func getConfigPath() string {
 }
 
 func ReadConfig() (*GrueConfig, error) {
+	return readConfig(false)
+}
+
+// ReadConfigLenient reads and locks the config like ReadConfig, but a
+// config that fails strict decoding, e.g. because of a misspelled key, is
+// still returned so that it can be edited or checked. Validate reports the
+// decoding error along with any other problems.
+func ReadConfigLenient() (*GrueConfig, error) {
+	return readConfig(true)
+}
+
+func readConfig(lenient bool) (*GrueConfig, error) {
 	var conf *GrueConfig = new(GrueConfig)
 	conf.path = getConfigPath()
 	err := conf.Lock()
 	if err != nil {
 		return nil, err
 	}
-	file, err := os.Open(conf.path)
+	err = conf.decodeFile(conf.path)
 	if os.IsNotExist(err) {
-		return writeDefConfig(conf.path)
+		def, err := writeDefConfig(conf.path)
+		if err != nil {
+			conf.Unlock()
+			return nil, err
+		}
+		// The lock was taken on conf, hand it over
+		def.locked = conf.locked
+		return def, nil
+	} else if cerr, ok := err.(*ConfigError); ok && lenient {
+		loose := &GrueConfig{path: conf.path, raw: conf.raw, locked: conf.locked, decodeErr: cerr}
+		json.Unmarshal(conf.raw, loose)
+		return loose, nil
 	} else if err != nil {
+		conf.Unlock()
 		return nil, err
 	}
-	defer file.Close()
-	dec := json.NewDecoder(file)
-	err = dec.Decode(conf)
-	if err != nil {
+	return conf, nil
+}
+
+// LoadConfig reads the config without taking the lock, for commands that
+// only ever read it.
+func LoadConfig() (*GrueConfig, error) {
+	var conf *GrueConfig = new(GrueConfig)
+	conf.path = getConfigPath()
+	if err := conf.decodeFile(conf.path); err != nil {
 		return nil, err
 	}
 	return conf, nil
 }
 
-func (conf *GrueConfig) AddAccount(name, uri string) error {
-	if conf.Accounts == nil {
-		conf.Accounts = make(map[string]AccountConfig)
+func (conf *GrueConfig) decodeFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	conf.raw = data
+	return conf.decode(conf.path, data)
+}
+
+// AddAccount adds the account name and saves the config, unless the account
+// makes the config invalid.
+func (conf *GrueConfig) AddAccount(name string, cfg AccountConfig, force bool) error {
+	if _, ok := conf.Accounts[name]; ok && !force {
+		return argErrorf("%s: account already exists", name)
+	}
+	return conf.change(func(conf *GrueConfig) error {
+		if conf.Accounts == nil {
+			conf.Accounts = make(map[string]AccountConfig)
+		}
+		conf.Accounts[name] = cfg
+		return nil
+	})
+}
+
+func (conf *GrueConfig) SetAccountURI(name, uri string) error {
+	cfg, ok := conf.Accounts[name]
+	if !ok {
+		return argErrorf("%s: account does not exist", name)
 	}
-	conf.Accounts[name] = AccountConfig{URI: uri}
+	cfg.URI = uri
+	conf.Accounts[name] = cfg
 	return conf.save()
 }
 
@@ -168,7 +369,7 @@ func (conf *GrueConfig) DeleteAccount(name string) error {
 		return nil
 	}
 	if _, ok := conf.Accounts[name]; !ok {
-		return fmt.Errorf("%s: account does not exist", name)
+		return argErrorf("%s: account does not exist", name)
 	}
 	delete(conf.Accounts, name)
 	return conf.save()
@@ -176,13 +377,13 @@ func (conf *GrueConfig) DeleteAccount(name string) error {
 
 func (conf *GrueConfig) RenameAccount(old, new string) error {
 	if conf.Accounts == nil {
-		return fmt.Errorf("%s: account does not exist", old)
+		return argErrorf("%s: account does not exist", old)
 	}
 	if _, ok := conf.Accounts[old]; !ok {
-		return fmt.Errorf("%s: account does not exist", old)
+		return argErrorf("%s: account does not exist", old)
 	}
 	if _, ok := conf.Accounts[new]; ok {
-		return fmt.Errorf("%s: account already exists", new)
+		return argErrorf("%s: account already exists", new)
 	}
 	conf.Accounts[new] = conf.Accounts[old]
 	delete(conf.Accounts, old)
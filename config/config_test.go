@@ -0,0 +1,124 @@
+package config
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAddressesUnmarshalJSON(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want Addresses
+	}{
+		{`"me@example.net"`, Addresses{"me@example.net"}},
+		{`""`, nil},
+		{`[]`, Addresses{}},
+		{`["me@example.net", "rss+{name}@example.net"]`, Addresses{"me@example.net", "rss+{name}@example.net"}},
+		// A single string is one address, even with a comma
+		{`"Doe, Jane <jane@example.net>"`, Addresses{"Doe, Jane <jane@example.net>"}},
+	} {
+		a := Addresses{"old@example.net"}
+		if err := json.Unmarshal([]byte(tc.in), &a); err != nil {
+			t.Errorf("Unmarshal(%s): %v", tc.in, err)
+		} else if !reflect.DeepEqual(a, tc.want) {
+			t.Errorf("Unmarshal(%s) = %#v, want %#v", tc.in, a, tc.want)
+		}
+	}
+
+	for _, in := range []string{`42`, `{"a": "b"}`, `[1]`} {
+		var a Addresses
+		if err := json.Unmarshal([]byte(in), &a); err == nil {
+			t.Errorf("Unmarshal(%s) = %#v, want error", in, a)
+		}
+	}
+}
+
+func TestAddressesRoundTrip(t *testing.T) {
+	for _, a := range []Addresses{{"me@example.net"}, {"me@example.net", "you@example.net"}} {
+		data, err := json.Marshal(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got Addresses
+		if err := json.Unmarshal(data, &got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, a) {
+			t.Errorf("round trip of %#v via %s = %#v", a, data, got)
+		}
+	}
+}
+
+func TestReadConfigCreatesAndUnlocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	t.Setenv("XDG_CONFIG_HOME", dir)
+
+	// The first run writes the default config, like grue init_cfg
+	conf, err := ReadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conf.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(dir, "grue.cfg.lock")); !os.IsNotExist(err) {
+		t.Fatalf("lock left behind after the first run: %v", err)
+	}
+	conf, err = ReadConfig()
+	if err != nil {
+		t.Fatalf("second run: %v", err)
+	}
+	conf.Unlock()
+}
+
+func TestReadConfigLenient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	file := path.Join(dir, "grue.cfg")
+	data := `{"Recipient": "me@example.net", "FromAddress": "grue@example.net", "NameFromat": "{title}"}`
+	if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if conf, err := ReadConfig(); err == nil {
+		conf.Unlock()
+		t.Fatal("ReadConfig accepted an unknown key")
+	}
+	conf, err := ReadConfigLenient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conf.Unlock()
+	errs, ok := conf.Validate().(ConfigErrors)
+	if !ok || len(errs) != 1 || !strings.Contains(errs[0].Msg, `unknown key "NameFromat"`) {
+		t.Errorf("Validate() = %v, want the unknown key", errs)
+	}
+
+	// The misspelled key can be fixed with edit
+	fix := `sed -i -e s/NameFromat/NameFormat/`
+	if err := conf.Edit(fix, func(error) bool { return false }); err != nil {
+		t.Fatalf("Edit: %v", err)
+	}
+	conf.Unlock()
+	conf, err = ReadConfig()
+	if err != nil {
+		t.Fatalf("ReadConfig after edit: %v", err)
+	}
+	defer conf.Unlock()
+	if conf.NameFormat != "{title}" {
+		t.Errorf("NameFormat = %q", conf.NameFormat)
+	}
+}
@@ -0,0 +1,59 @@
+package config
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+)
+
+func (conf *GrueConfig) copyToTemp() (string, error) {
+	src, err := os.Open(conf.path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	tmpfile, err := ioutil.TempFile(path.Dir(conf.path), path.Base(conf.path))
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(tmpfile, src)
+	tmpfile.Close()
+	if err != nil {
+		os.Remove(tmpfile.Name())
+		return "", err
+	}
+	return tmpfile.Name(), nil
+}
+
+// Edit opens a copy of the config file in editor and replaces the config
+// with it once it is valid. If the edited copy is invalid, retry is called
+// with the error to decide whether to edit it again.
+func (conf *GrueConfig) Edit(editor string, retry func(error) bool) error {
+	tmpname, err := conf.copyToTemp()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpname)
+	for {
+		cmd := exec.Command("sh", "-c", editor+` "$1"`, "sh", tmpname)
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err = cmd.Run(); err != nil {
+			return err
+		}
+		edited := &GrueConfig{path: conf.path}
+		err = edited.decodeFile(tmpname)
+		if err == nil {
+			err = edited.Validate()
+		}
+		if err == nil {
+			return os.Rename(tmpname, conf.path)
+		}
+		if !retry(err) {
+			return err
+		}
+	}
+}
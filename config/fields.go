@@ -0,0 +1,222 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// field returns the settable field called key in the struct pointed to by
+// ptr. Keys are matched case-insensitively against the JSON field names.
+func field(ptr interface{}, key string) (reflect.Value, error) {
+	v := reflect.ValueOf(ptr).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" || f.Type.Kind() == reflect.Map {
+			continue
+		}
+		if strings.EqualFold(f.Name, key) {
+			return v.Field(i), nil
+		}
+	}
+	return reflect.Value{}, argErrorf("%s: unknown setting", key)
+}
+
+func parseValue(t reflect.Type, key, value string) (reflect.Value, error) {
+	switch t.Kind() {
+	case reflect.Ptr:
+		elem, err := parseValue(t.Elem(), key, value)
+		if err != nil {
+			return elem, err
+		}
+		p := reflect.New(t.Elem())
+		p.Elem().Set(elem)
+		return p, nil
+	case reflect.String:
+		return reflect.ValueOf(value).Convert(t), nil
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return reflect.Value{}, argErrorf("%s: %q is not a boolean", key, value)
+		}
+		return reflect.ValueOf(b).Convert(t), nil
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return reflect.Value{}, argErrorf("%s: %q is not an integer", key, value)
+		}
+		return reflect.ValueOf(n).Convert(t), nil
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return reflect.Value{}, argErrorf("%s: %q is not a number", key, value)
+		}
+		return reflect.ValueOf(f).Convert(t), nil
+	case reflect.Slice:
+		if t.Elem().Kind() != reflect.String {
+			break
+		}
+		s := reflect.MakeSlice(t, 0, 0)
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				s = reflect.Append(s, reflect.ValueOf(v).Convert(t.Elem()))
+			}
+		}
+		return s, nil
+	}
+	return reflect.Value{}, argErrorf("%s: setting can't be changed from the command line", key)
+}
+
+func setField(ptr interface{}, key, value string) error {
+	f, err := field(ptr, key)
+	if err != nil {
+		return err
+	}
+	v, err := parseValue(f.Type(), key, value)
+	if err != nil {
+		return err
+	}
+	f.Set(v)
+	return nil
+}
+
+func unsetField(ptr interface{}, key string) error {
+	f, err := field(ptr, key)
+	if err != nil {
+		return err
+	}
+	f.Set(reflect.Zero(f.Type()))
+	return nil
+}
+
+// keys lists the fields of the struct pointed to by ptr which can be
+// changed with setField.
+func keys(ptr interface{}) []string {
+	var names []string
+	t := reflect.TypeOf(ptr).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" || f.Type.Kind() == reflect.Map {
+			continue
+		}
+		names = append(names, f.Name)
+	}
+	return names
+}
+
+// Set sets the field named key to value, which is parsed according to the
+// type of the field. Lists are given as comma separated values.
+func (cfg *AccountConfig) Set(key, value string) error {
+	return setField(cfg, key, value)
+}
+
+func (cfg *AccountConfig) Unset(key string) error {
+	if strings.EqualFold(key, "URI") {
+		return argErrorf("%s: setting is required", key)
+	}
+	return unsetField(cfg, key)
+}
+
+func AccountKeys() []string {
+	return keys(&AccountConfig{})
+}
+
+func GlobalKeys() []string {
+	return keys(&GrueConfig{})
+}
+
+// problems returns the messages of the errors Validate finds in conf,
+// without their location.
+func (conf *GrueConfig) problems() map[string]bool {
+	msgs := make(map[string]bool)
+	if errs, ok := conf.Validate().(ConfigErrors); ok {
+		for _, e := range errs {
+			msgs[e.Msg] = true
+		}
+	}
+	return msgs
+}
+
+// change applies f to a copy of conf and saves the result, unless f fails
+// or the change makes the config invalid. Problems the config already had
+// don't prevent changes, so they can be fixed one at a time.
+func (conf *GrueConfig) change(f func(*GrueConfig) error) error {
+	var buf bytes.Buffer
+	if err := conf.encode(&buf); err != nil {
+		return err
+	}
+	changed := &GrueConfig{path: conf.path, locked: conf.locked}
+	if err := json.Unmarshal(buf.Bytes(), changed); err != nil {
+		return err
+	}
+	if err := f(changed); err != nil {
+		return err
+	}
+	before := conf.problems()
+	var added []string
+	for msg := range changed.problems() {
+		if !before[msg] {
+			added = append(added, msg)
+		}
+	}
+	if len(added) > 0 {
+		sort.Strings(added)
+		return argErrorf("%s", strings.Join(added, "\n"))
+	}
+	if err := changed.save(); err != nil {
+		return err
+	}
+	*conf = *changed
+	return nil
+}
+
+// SetGlobal sets the global setting key to value and saves the config.
+func (conf *GrueConfig) SetGlobal(key, value string) error {
+	return conf.change(func(conf *GrueConfig) error {
+		return setField(conf, key, value)
+	})
+}
+
+// UnsetGlobal resets the global setting key to its zero value and saves
+// the config.
+func (conf *GrueConfig) UnsetGlobal(key string) error {
+	return conf.change(func(conf *GrueConfig) error {
+		return unsetField(conf, key)
+	})
+}
+
+// SetAccount sets the setting key of account name to value and saves the
+// config.
+func (conf *GrueConfig) SetAccount(name, key, value string) error {
+	return conf.change(func(conf *GrueConfig) error {
+		cfg, ok := conf.Accounts[name]
+		if !ok {
+			return argErrorf("%s: account does not exist", name)
+		}
+		if err := cfg.Set(key, value); err != nil {
+			return err
+		}
+		conf.Accounts[name] = cfg
+		return nil
+	})
+}
+
+// UnsetAccount removes the setting key from account name and saves the
+// config.
+func (conf *GrueConfig) UnsetAccount(name, key string) error {
+	return conf.change(func(conf *GrueConfig) error {
+		cfg, ok := conf.Accounts[name]
+		if !ok {
+			return argErrorf("%s: account does not exist", name)
+		}
+		if err := cfg.Unset(key); err != nil {
+			return err
+		}
+		conf.Accounts[name] = cfg
+		return nil
+	})
+}
@@ -0,0 +1,109 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func testConfig(t *testing.T) *GrueConfig {
+	dir, err := ioutil.TempDir("", "grue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	conf := &GrueConfig{
+		path:        path.Join(dir, "grue.cfg"),
+		FromAddress: "grue@example.net",
+		Recipient:   Addresses{"me@example.net"},
+		NameFormat:  "{name}: {title}",
+		Accounts:    map[string]AccountConfig{"blog": {URI: "https://example.net/feed"}},
+	}
+	if err := conf.save(); err != nil {
+		t.Fatal(err)
+	}
+	return conf
+}
+
+func savedConfig(t *testing.T, conf *GrueConfig) string {
+	buf, err := ioutil.ReadFile(conf.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf)
+}
+
+func TestSetRejectsInvalid(t *testing.T) {
+	conf := testConfig(t)
+	saved := savedConfig(t, conf)
+	if err := conf.SetGlobal("Concurrency", "0"); err == nil {
+		t.Error("SetGlobal(Concurrency, 0) succeeded")
+	} else if _, ok := err.(ArgError); !ok {
+		t.Errorf("SetGlobal(Concurrency, 0) = %T %v, want ArgError", err, err)
+	}
+	if conf.Concurrency != nil {
+		t.Errorf("Concurrency = %d, want unset", *conf.Concurrency)
+	}
+	if err := conf.SetAccount("blog", "Recipient", "not an address"); err == nil {
+		t.Error("SetAccount(blog, Recipient) succeeded with an invalid address")
+	}
+	if err := conf.UnsetGlobal("FromAddress"); err == nil {
+		t.Error("UnsetGlobal(FromAddress) succeeded")
+	}
+	if got := savedConfig(t, conf); got != saved {
+		t.Errorf("config changed by rejected edits:\n%s", got)
+	}
+}
+
+func TestSetKeepsExistingProblems(t *testing.T) {
+	conf := testConfig(t)
+	// An invalid config already on disk must not block unrelated changes.
+	uri := "::not a uri"
+	acc := conf.Accounts["blog"]
+	acc.URI = uri
+	conf.Accounts["blog"] = acc
+	if conf.Validate() == nil {
+		t.Fatalf("URI %q passes validation", uri)
+	}
+	if err := conf.SetGlobal("Concurrency", "4"); err != nil {
+		t.Fatalf("SetGlobal(Concurrency, 4) = %v", err)
+	}
+	if conf.Concurrency == nil || *conf.Concurrency != 4 {
+		t.Errorf("Concurrency = %v, want 4", conf.Concurrency)
+	}
+	if conf.Accounts["blog"].URI != uri {
+		t.Errorf("URI = %q, want %q", conf.Accounts["blog"].URI, uri)
+	}
+	if err := conf.SetAccount("blog", "URI", "https://example.net/atom"); err != nil {
+		t.Errorf("SetAccount(blog, URI) = %v", err)
+	}
+}
+
+func TestAddAccountRejectsInvalid(t *testing.T) {
+	conf := testConfig(t)
+	saved := savedConfig(t, conf)
+	recipient := Addresses{"not an address"}
+	for name, cfg := range map[string]AccountConfig{
+		"relative":      {URI: "feed.xml"},
+		"bad-recipient": {URI: "https://example.net/feed", Recipient: &recipient},
+	} {
+		if err := conf.AddAccount(name, cfg, false); err == nil {
+			t.Errorf("AddAccount(%s) succeeded", name)
+		} else if _, ok := err.(ArgError); !ok {
+			t.Errorf("AddAccount(%s) = %T %v, want ArgError", name, err, err)
+		}
+		if _, ok := conf.Accounts[name]; ok {
+			t.Errorf("AddAccount(%s) added the account", name)
+		}
+	}
+	if got := savedConfig(t, conf); got != saved {
+		t.Errorf("config changed by rejected accounts:\n%s", got)
+	}
+	if err := conf.AddAccount("news", AccountConfig{URI: "https://example.net/news"}, false); err != nil {
+		t.Errorf("AddAccount(news) = %v", err)
+	}
+	if err := conf.AddAccount("news", AccountConfig{URI: "https://example.net/other"}, false); err == nil {
+		t.Error("AddAccount(news) replaced an account without force")
+	}
+}
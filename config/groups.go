@@ -0,0 +1,56 @@
+package config
+
+import "reflect"
+
+// Account returns the settings of the account called name with the
+// defaults of its groups filled in. Groups are looked up by the account's
+// Tags in order, so for a setting neither the account nor an earlier group
+// sets the first group setting it wins. Headers are merged the same way.
+func (conf *GrueConfig) Account(name string) (AccountConfig, bool) {
+	cfg, ok := conf.Accounts[name]
+	if !ok {
+		return cfg, false
+	}
+	v := reflect.ValueOf(&cfg).Elem()
+	for _, tag := range cfg.Tags {
+		group, ok := conf.Groups[tag]
+		if !ok {
+			continue
+		}
+		g := reflect.ValueOf(group)
+		for i := 0; i < v.NumField(); i++ {
+			switch f, gf := v.Field(i), g.Field(i); f.Kind() {
+			case reflect.Ptr:
+				if f.IsNil() {
+					f.Set(gf)
+				}
+			case reflect.Map:
+				// Merge into a copy so the config itself isn't changed
+				if gf.Len() == 0 {
+					continue
+				}
+				merged := reflect.MakeMap(f.Type())
+				for _, k := range f.MapKeys() {
+					merged.SetMapIndex(k, f.MapIndex(k))
+				}
+				for _, k := range gf.MapKeys() {
+					if !merged.MapIndex(k).IsValid() {
+						merged.SetMapIndex(k, gf.MapIndex(k))
+					}
+				}
+				f.Set(merged)
+			}
+		}
+	}
+	return cfg, true
+}
+
+// HasTag reports whether the account is tagged with tag.
+func (cfg AccountConfig) HasTag(tag string) bool {
+	for _, t := range cfg.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -3,7 +3,6 @@ package config
 import (
 	"bufio"
 	"bytes"
-	"errors"
 	"io"
 	"os"
 	"strings"
@@ -28,7 +27,7 @@ func importDefault(text string) (*GrueConfig, error) {
 			return conf, nil
 		case hasPrefix(str, "to"):
 			rec := getValue(str)
-			conf.Recipient = rec
+			conf.Recipient = Addresses{rec}
 		case hasPrefix(str, "from"):
 			conf.FromAddress = getValue(str)
 		case hasPrefix(str, "name-format"):
@@ -61,11 +60,7 @@ func splitSections(data []byte, atEOF bool) (advance int, token []byte, err erro
 	}
 }
 
-func ImportCfg(args []string) error {
-	if len(args) != 1 {
-		return errors.New("usage: grue import <config>")
-	}
-	var cfgPath string = args[0]
+func ImportCfg(cfgPath string) error {
 	file, err := os.Open(cfgPath)
 	if err != nil {
 		return err
@@ -0,0 +1,513 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Values for FromPolicy
+const (
+	FromAuthor = "author"
+	FromFixed  = "fixed"
+)
+
+// Values for GrueConfig.MovedPolicy
+const (
+	MovedWarn   = "warn"
+	MovedUpdate = "update"
+	MovedIgnore = "ignore"
+)
+
+// Placeholders understood by the format settings
+var (
+	extensionKeys = []string{"categories", "feedtype", "image", "enclosure", "season", "episode", "episodetype",
+		"duration", "explicit", "creator", "subject"}
+	nameFormatKeys   = append([]string{"name", "title", "author"}, extensionKeys...)
+	listIdFormatKeys = []string{"name", "urihash", "namehash", "host"}
+	userAgentKeys    = []string{"version"}
+	recipientKeys    = []string{"name"}
+	headerKeys       = append([]string{"name", "title", "link", "guid", "author", "authoremail", "feedtitle", "feedlink"},
+		extensionKeys...)
+)
+
+// Headers grue sets itself, which can't be changed through Headers
+var reservedHeaders = []string{
+	"From", "Sender", "To", "Cc", "Bcc", "Subject", "Date", "X-Date",
+	"Message-Id", "In-Reply-To", "References", "User-Agent", "List-Id",
+	"X-RSS-Feed", "X-RSS-URI", "Mime-Version", "Content-Type",
+	"Content-Transfer-Encoding",
+}
+
+// ConfigError is an error in the config file, located at Line and Col if
+// they are known.
+type ConfigError struct {
+	Path string
+	Line int
+	Col  int
+	Msg  string
+}
+
+func (e *ConfigError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: %s", e.Path, e.Msg)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", e.Path, e.Line, e.Col, e.Msg)
+}
+
+// ConfigErrors collects all problems found when validating a config.
+type ConfigErrors []*ConfigError
+
+func (errs ConfigErrors) Error() string {
+	var msgs []string
+	for _, e := range errs {
+		msgs = append(msgs, e.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// ParseAge parses a duration like time.ParseDuration, additionally
+// accepting the suffixes "d" for days and "w" for weeks.
+func ParseAge(s string) (time.Duration, error) {
+	var unit time.Duration
+	switch {
+	case strings.HasSuffix(s, "d"):
+		unit = 24 * time.Hour
+	case strings.HasSuffix(s, "w"):
+		unit = 7 * 24 * time.Hour
+	default:
+		return time.ParseDuration(s)
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(s[:len(s)-1]), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return time.Duration(n * float64(unit)), nil
+}
+
+// lineCol converts a byte offset in data into a line and column.
+func lineCol(data []byte, offset int64) (int, int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	col := int(offset) - bytes.LastIndexByte(before, '\n')
+	return line, col
+}
+
+var unknownField = regexp.MustCompile(`^json: unknown field "(.*)"$`)
+
+// decode strictly decodes data into conf, rejecting unknown keys.
+func (conf *GrueConfig) decode(path string, data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(conf)
+	if err == nil {
+		return nil
+	}
+	cerr := &ConfigError{Path: path, Msg: err.Error()}
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		cerr.Line, cerr.Col = lineCol(data, e.Offset)
+	case *json.UnmarshalTypeError:
+		cerr.Line, cerr.Col = lineCol(data, e.Offset)
+		cerr.Msg = fmt.Sprintf("%s: expected %s, got %s", e.Field, e.Type, e.Value)
+	default:
+		if m := unknownField.FindStringSubmatch(err.Error()); m != nil {
+			cerr.Msg = fmt.Sprintf("unknown key %q", m[1])
+			if i := bytes.Index(data, []byte(strconv.Quote(m[1]))); i >= 0 {
+				cerr.Line, cerr.Col = lineCol(data, int64(i)+1)
+			}
+		}
+	}
+	return cerr
+}
+
+// validator accumulates the errors found in a config.
+type validator struct {
+	path string
+	data []byte
+	errs ConfigErrors
+}
+
+// locate finds the position of the value of the nested keys in the raw
+// config, e.g. locate("Accounts", "name", "URI").
+func (v *validator) locate(keys ...string) (int, int) {
+	var offset int
+	for _, k := range keys {
+		i := bytes.Index(v.data[offset:], []byte(strconv.Quote(k)))
+		if i < 0 {
+			return 0, 0
+		}
+		offset += i
+	}
+	return lineCol(v.data, int64(offset)+1)
+}
+
+func (v *validator) errorf(keys []string, format string, args ...interface{}) {
+	line, col := v.locate(keys...)
+	msg := strings.Join(keys, ".") + ": " + fmt.Sprintf(format, args...)
+	v.errs = append(v.errs, &ConfigError{Path: v.path, Line: line, Col: col, Msg: msg})
+}
+
+var placeholder = regexp.MustCompile(`\{[^{}]*\}`)
+
+func (v *validator) format(value string, allowed []string, keys ...string) {
+	for _, p := range placeholder.FindAllString(value, -1) {
+		name := strings.Trim(p, "{}")
+		ok := false
+		for _, a := range allowed {
+			if name == a {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			v.errorf(keys, "unknown placeholder %s, expected one of {%s}", p, strings.Join(allowed, "}, {"))
+		}
+	}
+}
+
+func (v *validator) duration(value string, keys ...string) {
+	if d, err := ParseAge(value); err != nil {
+		v.errorf(keys, "%v", err)
+	} else if d < 0 {
+		v.errorf(keys, "must not be negative")
+	}
+}
+
+func sortedKeys(m map[string]AccountConfig) []string {
+	var names []string
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// account checks the optional settings of an account or group found under
+// keys.
+func (v *validator) account(cfg AccountConfig, keys ...string) {
+	key := func(name string) []string {
+		return append(append([]string{}, keys...), name)
+	}
+	if cfg.NameFormat != nil {
+		v.format(*cfg.NameFormat, nameFormatKeys, key("NameFormat")...)
+	}
+	if cfg.UserAgent != nil {
+		v.format(*cfg.UserAgent, userAgentKeys, key("UserAgent")...)
+	}
+	if cfg.Recipient != nil {
+		v.addresses(*cfg.Recipient, key("Recipient")...)
+	}
+	if cfg.Cc != nil {
+		v.addresses(*cfg.Cc, key("Cc")...)
+	}
+	if cfg.Bcc != nil {
+		v.addresses(*cfg.Bcc, key("Bcc")...)
+	}
+	if cfg.Interval != nil {
+		v.duration(*cfg.Interval, key("Interval")...)
+	}
+	v.headers(cfg.Headers, key("Headers")...)
+	if cfg.FromPolicy != nil {
+		v.fromPolicy(*cfg.FromPolicy, key("FromPolicy")...)
+	}
+	v.backoff(cfg.BackoffBase, cfg.BackoffMultiplier, cfg.BackoffMax, cfg.BackoffJitter, keys...)
+}
+
+// backoff checks the Backoff settings found under keys.
+func (v *validator) backoff(base *string, multiplier *float64, max *string, jitter *float64, keys ...string) {
+	key := func(name string) []string {
+		return append(append([]string{}, keys...), name)
+	}
+	if base != nil {
+		v.duration(*base, key("BackoffBase")...)
+	}
+	if multiplier != nil && *multiplier < 1 {
+		v.errorf(key("BackoffMultiplier"), "must be at least 1")
+	}
+	if max != nil {
+		v.duration(*max, key("BackoffMax")...)
+	}
+	if jitter != nil && (*jitter < 0 || *jitter > 1) {
+		v.errorf(key("BackoffJitter"), "must be between 0 and 1")
+	}
+}
+
+func (v *validator) address(value string, keys ...string) {
+	if _, err := mail.ParseAddress(value); err != nil {
+		v.errorf(keys, "invalid address %q: %v", value, err)
+	}
+}
+
+func (v *validator) fromPolicy(value string, keys ...string) {
+	switch value {
+	case "", FromAuthor, FromFixed:
+	default:
+		v.errorf(keys, "expected %q or %q", FromAuthor, FromFixed)
+	}
+}
+
+// headers checks the names and templates of extra headers.
+func (v *validator) headers(headers map[string]string, keys ...string) {
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		key := append(append([]string{}, keys...), name)
+		valid := name != ""
+		for _, c := range name {
+			if c <= ' ' || c > '~' || c == ':' {
+				valid = false
+			}
+		}
+		if !valid {
+			v.errorf(key, "invalid header name")
+			continue
+		}
+		for _, r := range reservedHeaders {
+			if strings.EqualFold(name, r) {
+				v.errorf(key, "header is set by grue")
+			}
+		}
+		v.format(headers[name], headerKeys, key...)
+	}
+}
+
+// addresses checks a list of recipients, which may contain placeholders.
+func (v *validator) addresses(values Addresses, keys ...string) {
+	for _, value := range values {
+		v.address(value, keys...)
+		v.format(value, recipientKeys, keys...)
+	}
+}
+
+// logFile checks that the log file at value can be appended to, or created
+// in its directory.
+func (v *validator) logFile(value string, keys ...string) {
+	switch value {
+	case "", "-", "syslog":
+		return
+	}
+	f, err := os.OpenFile(value, os.O_WRONLY|os.O_APPEND, 0)
+	if err == nil {
+		f.Close()
+		return
+	}
+	if !os.IsNotExist(err) {
+		v.errorf(keys, "can't write to log file: %v", err)
+		return
+	}
+	dir := filepath.Dir(value)
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		v.errorf(keys, "directory %s does not exist", dir)
+		return
+	}
+	f, err = ioutil.TempFile(dir, ".grue-log")
+	if err != nil {
+		v.errorf(keys, "can't create the log file in %s", dir)
+		return
+	}
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// recipients checks the addresses the account called name sends to, with
+// the defaults of its groups filled in and {name} replaced. An address
+// valid on its own, like "rss+{name}@example.net", can still be invalid for
+// a name containing a space. Addresses that are already invalid as
+// configured have been reported by addresses.
+func (v *validator) recipients(conf *GrueConfig, name string) {
+	cfg, _ := conf.Account(name)
+	to := &conf.Recipient
+	if cfg.Recipient != nil {
+		to = cfg.Recipient
+	}
+	type addrList struct {
+		key   string
+		addrs *Addresses
+	}
+	lists := []addrList{{"Recipient", to}, {"Cc", cfg.Cc}, {"Bcc", cfg.Bcc}}
+	// Alerts about the account go to the global Recipient
+	alerts := conf.AlertFailures != nil || conf.AlertAge != nil
+	if alerts && conf.AdminRecipient == nil && to != &conf.Recipient {
+		lists = append(lists, addrList{"Recipient", &conf.Recipient})
+	}
+	for _, list := range lists {
+		if list.addrs == nil {
+			continue
+		}
+		for _, addr := range *list.addrs {
+			if !strings.Contains(addr, "{name}") {
+				continue
+			}
+			if _, err := mail.ParseAddress(addr); err != nil {
+				continue
+			}
+			expanded := strings.Replace(addr, "{name}", name, -1)
+			if _, err := mail.ParseAddress(expanded); err != nil {
+				v.errorf([]string{"Accounts", name}, "%s %q is not a valid address for this account: %v", list.key, expanded, err)
+			}
+		}
+	}
+}
+
+// pgp checks the OpenPGP settings, which need a keyring as soon as
+// anything is to be signed or encrypted.
+func (v *validator) pgp(conf *GrueConfig) {
+	used := conf.PgpSign != nil && *conf.PgpSign || conf.PgpEncrypt != nil && *conf.PgpEncrypt
+	var addrs []string
+	for addr := range conf.PgpRecipients {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		rcpt := conf.PgpRecipients[addr]
+		v.address(addr, "PgpRecipients", addr)
+		if rcpt.Sign != nil && *rcpt.Sign || rcpt.Encrypt != nil && *rcpt.Encrypt {
+			used = true
+		}
+	}
+	if used && conf.PgpKeyring == nil {
+		v.errorf([]string{"PgpKeyring"}, "must be set to sign or encrypt mail")
+	}
+}
+
+func (v *validator) uri(value string, keys ...string) {
+	u, err := url.Parse(value)
+	if err != nil {
+		v.errorf(keys, "%v", err)
+		return
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		v.errorf(keys, "%q is not an http(s) URL", value)
+	}
+}
+
+func (v *validator) hostPort(value string, keys ...string) {
+	parts := strings.Split(value, ":")
+	if len(parts) > 2 || parts[0] == "" {
+		v.errorf(keys, "%q is not a valid host[:port]", value)
+		return
+	}
+	if len(parts) == 2 {
+		port, err := strconv.Atoi(parts[1])
+		if err != nil || port < 1 || port > 65535 {
+			v.errorf(keys, "%q is not a valid port", parts[1])
+		}
+	}
+}
+
+// Validate checks the settings of conf for problems that would otherwise
+// only show up when fetching or sending mail.
+func (conf *GrueConfig) Validate() error {
+	v := &validator{path: conf.path, data: conf.raw}
+	if conf.decodeErr != nil {
+		v.errs = append(v.errs, conf.decodeErr)
+		if !json.Valid(conf.raw) {
+			// Nothing else was decoded
+			return v.errs
+		}
+	}
+	if len(conf.Recipient) == 0 {
+		v.errorf([]string{"Recipient"}, "must be set")
+	} else {
+		v.addresses(conf.Recipient, "Recipient")
+	}
+	if conf.AdminRecipient != nil {
+		v.address(*conf.AdminRecipient, "AdminRecipient")
+	}
+	v.address(conf.FromAddress, "FromAddress")
+	v.format(conf.NameFormat, nameFormatKeys, "NameFormat")
+	v.format(conf.ListIdFormat, listIdFormatKeys, "ListIdFormat")
+	v.format(conf.UserAgent, userAgentKeys, "UserAgent")
+	if conf.SmtpServer != nil {
+		v.hostPort(*conf.SmtpServer, "SmtpServer")
+	}
+	if (conf.DkimDomain == nil) != (conf.DkimKeyFile == nil) || (conf.DkimSelector == nil) != (conf.DkimKeyFile == nil) {
+		v.errorf([]string{"DkimKeyFile"}, "DkimDomain, DkimSelector and DkimKeyFile must be set together")
+	}
+	v.pgp(conf)
+	if (conf.SmtpUser == nil) != (conf.SmtpPass == nil) {
+		v.errorf([]string{"SmtpUser"}, "SmtpUser and SmtpPass must be set together")
+	}
+	if conf.AlertFailures != nil && *conf.AlertFailures < 1 {
+		v.errorf([]string{"AlertFailures"}, "must be at least 1")
+	}
+	if conf.AlertAge != nil {
+		v.duration(*conf.AlertAge, "AlertAge")
+	}
+	if conf.Concurrency != nil && *conf.Concurrency < 1 {
+		v.errorf([]string{"Concurrency"}, "must be at least 1")
+	}
+	if conf.HostConcurrency != nil && *conf.HostConcurrency < 0 {
+		v.errorf([]string{"HostConcurrency"}, "must not be negative")
+	}
+	if conf.HostDelay != nil {
+		v.duration(*conf.HostDelay, "HostDelay")
+	}
+	v.backoff(conf.BackoffBase, conf.BackoffMultiplier, conf.BackoffMax, conf.BackoffJitter)
+	v.headers(conf.Headers, "Headers")
+	if conf.LogLevel != nil {
+		switch strings.ToLower(*conf.LogLevel) {
+		case "", "debug", "info", "warn", "error":
+		default:
+			v.errorf([]string{"LogLevel"}, "expected debug, info, warn or error")
+		}
+	}
+	if conf.LogFile != nil {
+		v.logFile(*conf.LogFile, "LogFile")
+	}
+	if conf.LogFormat != nil {
+		switch *conf.LogFormat {
+		case "", "text", "json":
+		default:
+			v.errorf([]string{"LogFormat"}, "expected text or json")
+		}
+	}
+	if conf.FromPolicy != nil {
+		v.fromPolicy(*conf.FromPolicy, "FromPolicy")
+	}
+	if conf.MovedPolicy != nil {
+		switch *conf.MovedPolicy {
+		case "", MovedWarn, MovedUpdate, MovedIgnore:
+		default:
+			v.errorf([]string{"MovedPolicy"}, "expected %q, %q or %q", MovedWarn, MovedUpdate, MovedIgnore)
+		}
+	}
+
+	for _, name := range sortedKeys(conf.Groups) {
+		cfg := conf.Groups[name]
+		if cfg.URI != "" {
+			v.errorf([]string{"Groups", name, "URI"}, "can only be set for accounts")
+		}
+		if len(cfg.Tags) > 0 {
+			v.errorf([]string{"Groups", name, "Tags"}, "can only be set for accounts")
+		}
+		v.account(cfg, "Groups", name)
+	}
+	for _, name := range sortedKeys(conf.Accounts) {
+		cfg := conf.Accounts[name]
+		v.uri(cfg.URI, "Accounts", name, "URI")
+		v.account(cfg, "Accounts", name)
+		v.recipients(conf, name)
+	}
+	if len(v.errs) > 0 {
+		return v.errs
+	}
+	return nil
+}
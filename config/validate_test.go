@@ -0,0 +1,122 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateExpandedRecipients(t *testing.T) {
+	cc := Addresses{"cc+{name}@example.net"}
+	conf := &GrueConfig{
+		FromAddress: "grue@example.net",
+		Recipient:   Addresses{"rss+{name}@example.net"},
+		Groups:      map[string]AccountConfig{"news": {Cc: &cc}},
+		Accounts: map[string]AccountConfig{
+			"blog":    {URI: "https://example.net/feed"},
+			"my blog": {URI: "https://example.net/other", Tags: []string{"news"}},
+		},
+	}
+	err := conf.Validate()
+	errs, ok := err.(ConfigErrors)
+	if !ok {
+		t.Fatalf("Validate() = %v, want ConfigErrors", err)
+	}
+	want := []string{
+		`Accounts.my blog: Recipient "rss+my blog@example.net" is not a valid address`,
+		`Accounts.my blog: Cc "cc+my blog@example.net" is not a valid address`,
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("Validate() = %v, want %d errors", errs, len(want))
+	}
+	for i, w := range want {
+		if !strings.HasPrefix(errs[i].Msg, w) {
+			t.Errorf("error %d = %q, want prefix %q", i, errs[i].Msg, w)
+		}
+	}
+
+	// A name without spaces makes the same addresses valid
+	conf.Accounts["my-blog"] = conf.Accounts["my blog"]
+	delete(conf.Accounts, "my blog")
+	if err := conf.Validate(); err != nil {
+		t.Errorf("Validate() = %v", err)
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want time.Duration
+	}{
+		{"90m", 90 * time.Minute},
+		{"1h30m", 90 * time.Minute},
+		{"7d", 7 * 24 * time.Hour},
+		{"1.5d", 36 * time.Hour},
+		{"2w", 14 * 24 * time.Hour},
+		{"0d", 0},
+	} {
+		got, err := ParseAge(tc.in)
+		if err != nil {
+			t.Errorf("ParseAge(%q): %v", tc.in, err)
+		} else if got != tc.want {
+			t.Errorf("ParseAge(%q) = %v, want %v", tc.in, got, tc.want)
+		}
+	}
+	for _, in := range []string{"", "d", "xd", "7", "1y", "w3"} {
+		if got, err := ParseAge(in); err == nil {
+			t.Errorf("ParseAge(%q) = %v, want error", in, got)
+		}
+	}
+}
+
+func TestLineCol(t *testing.T) {
+	data := []byte("{\n  \"a\": 1,\n\n  \"b\": 2\n}")
+	for _, tc := range []struct {
+		offset    int64
+		line, col int
+	}{
+		{0, 1, 1},
+		{1, 1, 2},
+		{2, 2, 1},
+		{4, 2, 3},
+		{13, 4, 1},
+		{15, 4, 3},
+		// Offsets past the end are clamped
+		{1000, 5, 2},
+	} {
+		line, col := lineCol(data, tc.offset)
+		if line != tc.line || col != tc.col {
+			t.Errorf("lineCol(%d) = %d:%d, want %d:%d", tc.offset, line, col, tc.line, tc.col)
+		}
+	}
+}
+
+func TestValidateLogFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, tc := range []struct {
+		file string
+		ok   bool
+	}{
+		{"syslog", true},
+		{"-", true},
+		{path.Join(dir, "grue.log"), true},
+		{path.Join(dir, "missing", "grue.log"), false},
+		{dir, false},
+	} {
+		v := &validator{}
+		v.logFile(tc.file, "LogFile")
+		if ok := len(v.errs) == 0; ok != tc.ok {
+			t.Errorf("logFile(%q) errors = %v, want ok %t", tc.file, v.errs, tc.ok)
+		}
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("logFile left %d files behind", len(files))
+	}
+}
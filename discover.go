@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/mmcdole/gofeed"
+	"golang.org/x/net/html"
+)
+
+// Link types announcing a feed through <link rel="alternate">
+var feedTypes = map[string]bool{
+	"application/rss+xml":   true,
+	"application/atom+xml":  true,
+	"application/feed+json": true,
+	"application/json":      true,
+	"application/rdf+xml":   true,
+}
+
+type DiscoveredFeed struct {
+	URI   string
+	Title string
+	Type  string
+}
+
+func isAlternate(rel string) bool {
+	for _, r := range strings.Fields(rel) {
+		if strings.EqualFold(r, "alternate") {
+			return true
+		}
+	}
+	return false
+}
+
+// discoverFeeds returns the feeds advertised by the HTML page in body.
+// Relative links are resolved against base.
+func discoverFeeds(base *url.URL, body io.Reader) []DiscoveredFeed {
+	var feeds []DiscoveredFeed
+	seen := make(map[string]bool)
+	z := html.NewTokenizer(body)
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			return feeds
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			if string(name) == "body" {
+				return feeds
+			}
+			if string(name) != "link" || !hasAttr {
+				continue
+			}
+			var rel, typ, href, title string
+			for hasAttr {
+				var key, val []byte
+				key, val, hasAttr = z.TagAttr()
+				switch string(key) {
+				case "rel":
+					rel = string(val)
+				case "type":
+					typ = strings.ToLower(strings.TrimSpace(string(val)))
+				case "href":
+					href = strings.TrimSpace(string(val))
+				case "title":
+					title = string(val)
+				}
+			}
+			if !isAlternate(rel) || !feedTypes[typ] || href == "" {
+				continue
+			}
+			u, err := base.Parse(href)
+			if err != nil || seen[u.String()] {
+				continue
+			}
+			seen[u.String()] = true
+			feeds = append(feeds, DiscoveredFeed{URI: u.String(), Title: title, Type: typ})
+		}
+	}
+}
+
+func getURI(uri string) (*http.Response, []byte, error) {
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("User-Agent", gofeed.NewParser().UserAgent)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, nil, gofeed.HTTPError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+		}
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	return resp, body, err
+}
+
+// resolveFeed fetches uri and returns the parsed feed along with its
+// location. If uri points to an HTML page advertising exactly one feed that
+// feed is used instead, if it advertises several they are listed in the
+// returned error.
+func resolveFeed(uri string) (string, *gofeed.Feed, error) {
+	resp, body, err := getURI(uri)
+	if err != nil {
+		return "", nil, withExit(exitCode(err), fmt.Errorf("%s: %v", uri, err))
+	}
+	parser := gofeed.NewParser()
+	feed, err := parser.Parse(bytes.NewReader(body))
+	if err == nil {
+		return uri, feed, nil
+	}
+	if err != gofeed.ErrFeedTypeNotDetected && !strings.Contains(resp.Header.Get("Content-Type"), "html") {
+		return "", nil, withExit(EX_DATAERR, fmt.Errorf("%s: %v", uri, err))
+	}
+
+	feeds := discoverFeeds(resp.Request.URL, bytes.NewReader(body))
+	switch len(feeds) {
+	case 0:
+		return "", nil, withExit(EX_DATAERR, fmt.Errorf("%s: not a feed and no feeds advertised", uri))
+	case 1:
+		_, body, err = getURI(feeds[0].URI)
+		if err != nil {
+			return "", nil, withExit(exitCode(err), fmt.Errorf("%s: %v", feeds[0].URI, err))
+		}
+		feed, err = parser.Parse(bytes.NewReader(body))
+		if err != nil {
+			return "", nil, withExit(EX_DATAERR, fmt.Errorf("%s: %v", feeds[0].URI, err))
+		}
+		return feeds[0].URI, feed, nil
+	default:
+		var b strings.Builder
+		fmt.Fprintf(&b, "%s: found %d feeds, choose one:", uri, len(feeds))
+		for _, f := range feeds {
+			fmt.Fprintf(&b, "\n\t%s\t%s (%s)", f.URI, f.Title, f.Type)
+		}
+		return "", nil, withExit(EX_USAGE, errors.New(b.String()))
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const discoverRSS = `<?xml version="1.0"?>
+<rss version="2.0"><channel><title>Blog</title><link>https://example.net/</link>
+<item><title>Hello</title><link>https://example.net/hello</link></item>
+</channel></rss>`
+
+func TestDiscoverFeeds(t *testing.T) {
+	base, _ := url.Parse("https://example.net/blog/")
+	page := `<!DOCTYPE html><html><head>
+<link rel="stylesheet" href="style.css">
+<link rel="alternate" type="application/rss+xml" title="RSS" href="feed.xml">
+<link rel="Alternate home" type="Application/Atom+XML" title="Atom" href="/atom.xml" />
+<link rel="alternate" type="text/html" hreflang="de" href="/de/">
+<link rel="alternate" type="application/rss+xml" href="https://example.net/blog/feed.xml">
+<link rel="alternate" type="application/feed+json" href="">
+</head><body>
+<link rel="alternate" type="application/rss+xml" href="/body.xml">
+</body></html>`
+	want := []DiscoveredFeed{
+		{URI: "https://example.net/blog/feed.xml", Title: "RSS", Type: "application/rss+xml"},
+		{URI: "https://example.net/atom.xml", Title: "Atom", Type: "application/atom+xml"},
+	}
+	if got := discoverFeeds(base, strings.NewReader(page)); !reflect.DeepEqual(got, want) {
+		t.Errorf("discoverFeeds() = %+v, want %+v", got, want)
+	}
+}
+
+func discoverServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/blog/feed.xml", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		w.Write([]byte(discoverRSS))
+	})
+	mux.HandleFunc("/blog/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(`<html><head><link rel="alternate" type="application/rss+xml" href="feed.xml"></head></html>`))
+	})
+	mux.Handle("/moved", http.RedirectHandler("/blog/", http.StatusMovedPermanently))
+	mux.HandleFunc("/many", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<html><head>
+<link rel="alternate" type="application/rss+xml" title="Posts" href="/blog/feed.xml">
+<link rel="alternate" type="application/atom+xml" title="Comments" href="/comments.xml">
+</head></html>`))
+	})
+	mux.HandleFunc("/none", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<html><head><title>No feeds</title></head></html>`))
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestResolveFeed(t *testing.T) {
+	srv := discoverServer(t)
+	feedURI := srv.URL + "/blog/feed.xml"
+	for _, tc := range []struct {
+		path string
+		want string
+	}{
+		{"/blog/feed.xml", feedURI},
+		{"/blog/", feedURI},
+		// Relative links are resolved against the page after redirects
+		{"/moved", feedURI},
+	} {
+		uri, feed, err := resolveFeed(srv.URL + tc.path)
+		if err != nil {
+			t.Errorf("resolveFeed(%s): %v", tc.path, err)
+			continue
+		}
+		if uri != tc.want || feed.Title != "Blog" {
+			t.Errorf("resolveFeed(%s) = %s, %q, want %s, \"Blog\"", tc.path, uri, feed.Title, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		path string
+		code int
+		msg  string
+	}{
+		{"/many", EX_USAGE, "found 2 feeds"},
+		{"/none", EX_DATAERR, "no feeds advertised"},
+		{"/missing", EX_UNAVAILABLE, "404"},
+	} {
+		_, _, err := resolveFeed(srv.URL + tc.path)
+		if err == nil {
+			t.Errorf("resolveFeed(%s) succeeded", tc.path)
+			continue
+		}
+		if exitCode(err) != tc.code || !strings.Contains(err.Error(), tc.msg) {
+			t.Errorf("resolveFeed(%s) = %v (exit %d), want %q (exit %d)", tc.path, err, exitCode(err), tc.msg, tc.code)
+		}
+	}
+	_, _, err := resolveFeed(srv.URL + "/many")
+	for _, uri := range []string{feedURI, srv.URL + "/comments.xml"} {
+		if err == nil || !strings.Contains(err.Error(), uri) {
+			t.Errorf("resolveFeed(/many) = %v, want %s listed", err, uri)
+		}
+	}
+}
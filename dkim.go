@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/c-14/grue/config"
+	"gopkg.in/gomail.v2"
+)
+
+// Headers signed if present, following RFC 6376 section 5.4.1
+var dkimHeaders = []string{
+	"From", "Sender", "Reply-To", "Subject", "Date", "To", "Cc",
+	"Message-Id", "In-Reply-To", "References", "List-Id", "Mime-Version",
+	"Content-Type", "Content-Transfer-Encoding",
+}
+
+// DkimSigner adds a DKIM-Signature to messages before passing them on to
+// another Sender. Headers and body are canonicalized with the relaxed
+// algorithms.
+type DkimSigner struct {
+	domain   string
+	selector string
+	key      crypto.Signer
+	sender   gomail.Sender
+}
+
+func loadDkimKey(path string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM encoded key found", path)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("%s: unsupported key type %T", path, key)
+}
+
+// newDkimSigner returns a DkimSigner for sender if conf has DKIM
+// configured, and sender itself otherwise.
+func newDkimSigner(conf *config.GrueConfig, sender gomail.Sender) (gomail.Sender, error) {
+	if conf.DkimKeyFile == nil {
+		return sender, nil
+	}
+	if conf.DkimDomain == nil || conf.DkimSelector == nil {
+		return nil, withExit(EX_CONFIG, errors.New("DkimKeyFile: DkimDomain and DkimSelector must be set too"))
+	}
+	key, err := loadDkimKey(*conf.DkimKeyFile)
+	if err != nil {
+		return nil, withExit(EX_CONFIG, fmt.Errorf("DkimKeyFile: %v", err))
+	}
+	return &DkimSigner{
+		domain:   *conf.DkimDomain,
+		selector: *conf.DkimSelector,
+		key:      key,
+		sender:   sender,
+	}, nil
+}
+
+func (s *DkimSigner) Send(from string, to []string, msg io.WriterTo) error {
+	var buf bytes.Buffer
+	if _, err := msg.WriteTo(&buf); err != nil {
+		return err
+	}
+	sig, err := s.sign(buf.Bytes(), time.Now())
+	if err != nil {
+		return err
+	}
+	return s.sender.Send(from, to, bytes.NewReader(append([]byte(sig), buf.Bytes()...)))
+}
+
+func (s *DkimSigner) algorithm() string {
+	if _, ok := s.key.(ed25519.PrivateKey); ok {
+		return "ed25519-sha256"
+	}
+	return "rsa-sha256"
+}
+
+// sign returns the DKIM-Signature header field for msg.
+func (s *DkimSigner) sign(msg []byte, now time.Time) (string, error) {
+	headers, body := splitMessage(msg)
+	bodyHash := sha256.Sum256(relaxedBody(body))
+
+	var names []string
+	var signed strings.Builder
+	for _, name := range dkimHeaders {
+		if h, ok := lastHeader(headers, name); ok {
+			names = append(names, strings.ToLower(name))
+			signed.WriteString(relaxedHeader(h) + "\r\n")
+		}
+	}
+	sig := fmt.Sprintf("DKIM-Signature: v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s;\r\n\tt=%d; h=%s;\r\n\tbh=%s;\r\n\tb=",
+		s.algorithm(), s.domain, s.selector, now.Unix(), strings.Join(names, ":"),
+		base64.StdEncoding.EncodeToString(bodyHash[:]))
+	signed.WriteString(relaxedHeader(sig))
+
+	digest := sha256.Sum256([]byte(signed.String()))
+	opts := crypto.SHA256
+	if _, ok := s.key.(ed25519.PrivateKey); ok {
+		// RFC 8463 signs the SHA-256 hash with PureEdDSA
+		opts = crypto.Hash(0)
+	}
+	b, err := s.key.Sign(rand.Reader, digest[:], opts)
+	if err != nil {
+		return "", err
+	}
+	return sig + base64.StdEncoding.EncodeToString(b) + "\r\n", nil
+}
+
+// splitMessage splits msg into its header fields, including their folded
+// lines, and its body. Line endings are converted to CRLF.
+func splitMessage(msg []byte) ([]string, []byte) {
+	msg = bytes.Replace(msg, []byte("\r\n"), []byte("\n"), -1)
+	msg = bytes.Replace(msg, []byte("\n"), []byte("\r\n"), -1)
+	head, body := msg, []byte(nil)
+	if i := bytes.Index(msg, []byte("\r\n\r\n")); i >= 0 {
+		head, body = msg[:i], msg[i+4:]
+	}
+	var headers []string
+	for _, line := range strings.Split(string(head), "\r\n") {
+		if len(headers) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			headers[len(headers)-1] += "\r\n" + line
+		} else {
+			headers = append(headers, line)
+		}
+	}
+	return headers, body
+}
+
+// lastHeader returns the last header field called name.
+func lastHeader(headers []string, name string) (string, bool) {
+	for i := len(headers) - 1; i >= 0; i-- {
+		if j := strings.IndexByte(headers[i], ':'); j >= 0 && strings.EqualFold(strings.TrimSpace(headers[i][:j]), name) {
+			return headers[i], true
+		}
+	}
+	return "", false
+}
+
+var wsp = regexp.MustCompile(`[ \t]+`)
+
+// relaxedHeader canonicalizes a header field as in RFC 6376 section 3.4.2.
+func relaxedHeader(h string) string {
+	i := strings.IndexByte(h, ':')
+	name := strings.ToLower(strings.TrimSpace(h[:i]))
+	value := strings.Replace(h[i+1:], "\r\n", "", -1)
+	value = strings.TrimSpace(wsp.ReplaceAllString(value, " "))
+	return name + ":" + value
+}
+
+// relaxedBody canonicalizes a body as in RFC 6376 section 3.4.4.
+func relaxedBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(wsp.ReplaceAllString(line, " "), " ")
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+var (
+	dkimTag    = regexp.MustCompile(`(?:^|;)\s*([a-z]+)\s*=\s*([^;]*)`)
+	dkimSigTag = regexp.MustCompile(`;\s*b=`)
+)
+
+// dkimVerify checks the DKIM-Signature grue added to msg against pub.
+func dkimVerify(msg []byte, pub crypto.PublicKey) error {
+	headers, body := splitMessage(msg)
+	sigHeader, ok := lastHeader(headers, "DKIM-Signature")
+	if !ok {
+		return errors.New("dkim: no signature found")
+	}
+	tags := make(map[string]string)
+	value := sigHeader[strings.IndexByte(sigHeader, ':')+1:]
+	for _, m := range dkimTag.FindAllStringSubmatch(value, -1) {
+		tags[m[1]] = strings.Join(strings.Fields(m[2]), "")
+	}
+	if tags["c"] != "relaxed/relaxed" {
+		return fmt.Errorf("dkim: unsupported canonicalization %q", tags["c"])
+	}
+	bodyHash := sha256.Sum256(relaxedBody(body))
+	if tags["bh"] != base64.StdEncoding.EncodeToString(bodyHash[:]) {
+		return errors.New("dkim: body hash mismatch")
+	}
+
+	var signed strings.Builder
+	for _, name := range strings.Split(tags["h"], ":") {
+		if h, ok := lastHeader(headers, name); ok {
+			signed.WriteString(relaxedHeader(h) + "\r\n")
+		}
+	}
+	loc := dkimSigTag.FindAllStringIndex(sigHeader, -1)
+	if loc == nil {
+		return errors.New("dkim: signature has no b= tag")
+	}
+	signed.WriteString(relaxedHeader(sigHeader[:loc[len(loc)-1][1]]))
+	digest := sha256.Sum256([]byte(signed.String()))
+	b, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return fmt.Errorf("dkim: %v", err)
+	}
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], b)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pub, digest[:], b) {
+			err = errors.New("verification failed")
+		}
+	default:
+		err = fmt.Errorf("unsupported key type %T", pub)
+	}
+	if err != nil {
+		return fmt.Errorf("dkim: %v", err)
+	}
+	return nil
+}
+
+// dkimRecord returns the DNS TXT record publishing the public key of s.
+func (s *DkimSigner) dkimRecord() (string, error) {
+	var k string
+	var p []byte
+	switch pub := s.key.Public().(type) {
+	case *rsa.PublicKey:
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			return "", err
+		}
+		k, p = "rsa", der
+	case ed25519.PublicKey:
+		k, p = "ed25519", pub
+	}
+	return fmt.Sprintf("%s._domainkey.%s. IN TXT \"v=DKIM1; k=%s; p=%s\"",
+		s.selector, s.domain, k, base64.StdEncoding.EncodeToString(p)), nil
+}
+
+// checkDkim signs a message with the configured key and verifies the
+// signature.
+func checkDkim(conf *config.GrueConfig) error {
+	sender, err := newDkimSigner(conf, nil)
+	if err != nil {
+		return err
+	}
+	s := sender.(*DkimSigner)
+	m := gomail.NewMessage()
+	m.SetHeader("From", conf.FromAddress)
+	m.SetHeader("To", conf.Recipient...)
+	m.SetHeader("Subject", "grue DKIM check")
+	m.SetBody("text/plain", "DKIM check\n")
+	var buf bytes.Buffer
+	if _, err = m.WriteTo(&buf); err != nil {
+		return err
+	}
+	sig, err := s.sign(buf.Bytes(), time.Now())
+	if err != nil {
+		return err
+	}
+	if err = dkimVerify(append([]byte(sig), buf.Bytes()...), s.key.Public()); err != nil {
+		return withExit(EX_CONFIG, fmt.Errorf("DkimKeyFile: %v", err))
+	}
+	return nil
+}
+
+func dkimRecordCmd(args []string, conf *config.GrueConfig) error {
+	if len(args) != 0 {
+		return usageErrorf("usage: grue dkim-record")
+	}
+	if conf.DkimKeyFile == nil {
+		return withExit(EX_CONFIG, errors.New("DkimKeyFile: not set"))
+	}
+	sender, err := newDkimSigner(conf, nil)
+	if err != nil {
+		return err
+	}
+	record, err := sender.(*DkimSigner).dkimRecord()
+	if err != nil {
+		return err
+	}
+	fmt.Println(record)
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/c-14/grue/config"
+	"gopkg.in/gomail.v2"
+)
+
+func testMessage(t *testing.T) []byte {
+	m := gomail.NewMessage()
+	m.SetHeader("From", m.FormatAddress("grue@example.net", "Grüne Feeds"))
+	m.SetHeader("To", "me@example.net")
+	m.SetHeader("Subject", "Blog: Überraschung – ein sehr langer Titel, der über mehrere Zeilen gefaltet werden muss, damit er passt")
+	m.SetBody("text/plain", "Hallo  Welt \t\n\nzweiter Absatz\n\n\n\n")
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	// gomail doesn't fold long headers, so fold between encoded-words
+	return bytes.Replace(buf.Bytes(), []byte("?= =?"), []byte("?=\r\n =?"), -1)
+}
+
+func TestDkimSignVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := testMessage(t)
+	headers, _ := splitMessage(msg)
+	if subject, _ := lastHeader(headers, "Subject"); !strings.Contains(subject, "\r\n ") {
+		t.Fatalf("Subject isn't folded: %q", subject)
+	}
+
+	for _, key := range []crypto.Signer{rsaKey, edKey} {
+		s := &DkimSigner{domain: "example.net", selector: "grue", key: key}
+		sig, err := s.sign(msg, time.Now())
+		if err != nil {
+			t.Fatalf("%s: sign: %v", s.algorithm(), err)
+		}
+		signed := append([]byte(sig), msg...)
+		if err := dkimVerify(signed, key.Public()); err != nil {
+			t.Errorf("%s: %v", s.algorithm(), err)
+		}
+
+		// Relaxed canonicalization survives refolding, LF line endings
+		// and more trailing blank lines
+		changed := bytes.Replace(signed, []byte("\r\n "), []byte("\r\n\t  "), -1)
+		changed = bytes.Replace(changed, []byte("\r\n"), []byte("\n"), -1)
+		changed = append(changed, "\n\n"...)
+		if err := dkimVerify(changed, key.Public()); err != nil {
+			t.Errorf("%s: after refolding: %v", s.algorithm(), err)
+		}
+
+		tampered := bytes.Replace(signed, []byte("zweiter"), []byte("dritter"), 1)
+		if err := dkimVerify(tampered, key.Public()); err == nil {
+			t.Errorf("%s: changed body verifies", s.algorithm())
+		}
+		tampered = bytes.Replace(signed, []byte("To: me@"), []byte("To: you@"), 1)
+		if err := dkimVerify(tampered, key.Public()); err == nil {
+			t.Errorf("%s: changed header verifies", s.algorithm())
+		}
+	}
+}
+
+func TestNewDkimSignerIncomplete(t *testing.T) {
+	file := "/nonexistent/dkim.pem"
+	domain := "example.net"
+	conf := &config.GrueConfig{DkimKeyFile: &file, DkimDomain: &domain}
+	if _, err := newDkimSigner(conf, nil); exitCode(err) != EX_CONFIG {
+		t.Errorf("newDkimSigner without DkimSelector = %v, want config error", err)
+	}
+}
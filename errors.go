@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+
+	"github.com/c-14/grue/config"
+	"github.com/mmcdole/gofeed"
+)
+
+// exitError associates one of the exit codes from exits.go with an error.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func withExit(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &exitError{code: code, err: err}
+}
+
+func usageErrorf(format string, args ...interface{}) error {
+	return &exitError{code: EX_USAGE, err: fmt.Errorf(format, args...)}
+}
+
+// parseFlags parses args with fs, marking errors as usage errors.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	err := fs.Parse(args)
+	if err == nil || err == flag.ErrHelp {
+		return err
+	}
+	return withExit(EX_USAGE, err)
+}
+
+// exitCode maps err to the exit code grue should terminate with.
+func exitCode(err error) int {
+	switch e := err.(type) {
+	case nil:
+		return EX_OK
+	case *exitError:
+		return e.code
+	case *partialSendError:
+		return exitCode(e.err)
+	case *config.ConfigError, config.ConfigErrors:
+		return EX_CONFIG
+	case config.ArgError:
+		return EX_USAGE
+	case *json.SyntaxError, *json.UnmarshalTypeError:
+		return EX_DATAERR
+	case gofeed.HTTPError:
+		if e.StatusCode == 429 || e.StatusCode >= 500 {
+			return EX_TEMPFAIL
+		}
+		return EX_UNAVAILABLE
+	case *url.Error, net.Error:
+		return EX_TEMPFAIL
+	case *os.PathError:
+		switch {
+		case os.IsNotExist(e):
+			return EX_NOINPUT
+		case os.IsPermission(e):
+			return EX_NOPERM
+		}
+		return EX_IOERR
+	}
+	if err == flag.ErrHelp {
+		return EX_OK
+	}
+	if err == gofeed.ErrFeedTypeNotDetected {
+		return EX_DATAERR
+	}
+	return EX_SOFTWARE
+}
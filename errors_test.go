@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/c-14/grue/config"
+	"github.com/mmcdole/gofeed"
+)
+
+func TestExitCode(t *testing.T) {
+	var syntaxErr error
+	var v interface{}
+	if syntaxErr = json.Unmarshal([]byte("{"), &v); syntaxErr == nil {
+		t.Fatal("no syntax error")
+	}
+	for _, tc := range []struct {
+		err  error
+		want int
+	}{
+		{nil, EX_OK},
+		{flag.ErrHelp, EX_OK},
+		{usageErrorf("no such account %q", "blog"), EX_USAGE},
+		{withExit(EX_NOPERM, errors.New("denied")), EX_NOPERM},
+		{&config.ConfigError{Msg: "bad"}, EX_CONFIG},
+		{config.ConfigErrors{{Msg: "bad"}}, EX_CONFIG},
+		{syntaxErr, EX_DATAERR},
+		{gofeed.ErrFeedTypeNotDetected, EX_DATAERR},
+		{gofeed.HTTPError{StatusCode: 404}, EX_UNAVAILABLE},
+		{gofeed.HTTPError{StatusCode: 410}, EX_UNAVAILABLE},
+		{gofeed.HTTPError{StatusCode: 429}, EX_TEMPFAIL},
+		{gofeed.HTTPError{StatusCode: 502}, EX_TEMPFAIL},
+		{&url.Error{Op: "Get", URL: "https://example.net", Err: context.DeadlineExceeded}, EX_TEMPFAIL},
+		{&os.PathError{Op: "open", Path: "feeds.opml", Err: os.ErrNotExist}, EX_NOINPUT},
+		{&os.PathError{Op: "open", Path: "feeds.opml", Err: os.ErrPermission}, EX_NOPERM},
+		{&partialSendError{err: withExit(EX_UNAVAILABLE, errors.New("refused"))}, EX_UNAVAILABLE},
+		{fmt.Errorf("something else"), EX_SOFTWARE},
+	} {
+		if got := exitCode(tc.err); got != tc.want {
+			t.Errorf("exitCode(%T %v) = %d, want %d", tc.err, tc.err, got, tc.want)
+		}
+	}
+}
@@ -18,3 +18,8 @@ const (
 	EX_NOPERM      = 77 /* permission denied */
 	EX_CONFIG      = 78 /* configuration error */
 )
+
+// Not part of sysexits.h
+const (
+	EX_PARTIAL = 3 /* some feeds could not be fetched */
+)
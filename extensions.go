@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/mmcdole/gofeed"
+)
+
+// feedType returns the format and version of feed, e.g. "rss 2.0",
+// "atom 1.0" or "json 1.1".
+func feedType(feed *gofeed.Feed) string {
+	// JSON Feed versions are URLs like https://jsonfeed.org/version/1.1
+	version := feed.FeedVersion
+	if i := strings.LastIndexByte(version, '/'); i >= 0 {
+		version = version[i+1:]
+	}
+	return strings.TrimSpace(feed.FeedType + " " + version)
+}
+
+// dcValues returns the non-empty Dublin Core elements called name of item.
+// Like dc:date in hasNewerDate they are read from the raw extensions, as
+// gofeed only translates them for RSS.
+func dcValues(item *gofeed.Item, name string) []string {
+	var values []string
+	for _, e := range item.Extensions["dc"][name] {
+		if v := strings.TrimSpace(e.Value); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// itemCategories returns the categories of item together with its Dublin
+// Core subjects and iTunes keywords, leaving out duplicates.
+func itemCategories(item *gofeed.Item) []string {
+	all := append([]string{}, item.Categories...)
+	all = append(all, dcValues(item, "subject")...)
+	if item.ITunesExt != nil {
+		all = append(all, strings.Split(item.ITunesExt.Keywords, ",")...)
+	}
+	var categories []string
+	seen := make(map[string]bool)
+	for _, c := range all {
+		c = strings.TrimSpace(c)
+		if c != "" && !seen[strings.ToLower(c)] {
+			seen[strings.ToLower(c)] = true
+			categories = append(categories, c)
+		}
+	}
+	return categories
+}
+
+// itemImage returns the URL of the image of item, falling back to its
+// iTunes episode art and image enclosures.
+func itemImage(item *gofeed.Item) string {
+	if item.Image != nil && item.Image.URL != "" {
+		return item.Image.URL
+	}
+	if item.ITunesExt != nil && item.ITunesExt.Image != "" {
+		return item.ITunesExt.Image
+	}
+	for _, enc := range item.Enclosures {
+		if strings.HasPrefix(enc.Type, "image/") {
+			return enc.URL
+		}
+	}
+	return ""
+}
+
+// itemEnclosure returns the URL of the first enclosure of item which isn't
+// an image, usually a podcast episode.
+func itemEnclosure(item *gofeed.Item) string {
+	for _, enc := range item.Enclosures {
+		if !strings.HasPrefix(enc.Type, "image/") && enc.URL != "" {
+			return enc.URL
+		}
+	}
+	return ""
+}
+
+// extensionPlaceholders returns the replacements for the placeholders of
+// the feed type and the extension data of item, which NameFormat and
+// Headers have in common.
+func extensionPlaceholders(feed *gofeed.Feed, item *gofeed.Item) []string {
+	ep := itemEpisode(item)
+	return []string{
+		"{categories}", strings.Join(itemCategories(item), ", "),
+		"{feedtype}", feedType(feed),
+		"{image}", itemImage(item), "{enclosure}", itemEnclosure(item),
+		"{season}", ep.Season, "{episode}", ep.Episode,
+		"{episodetype}", ep.EpisodeType, "{duration}", ep.Duration,
+		"{explicit}", ep.Explicit,
+		"{creator}", strings.Join(dcValues(item, "creator"), ", "),
+		"{subject}", strings.Join(dcValues(item, "subject"), ", "),
+	}
+}
+
+// Episode holds the iTunes details of a podcast episode.
+type Episode struct {
+	Season      string
+	Episode     string
+	EpisodeType string
+	Duration    string
+	Explicit    string
+}
+
+func itemEpisode(item *gofeed.Item) Episode {
+	ext := item.ITunesExt
+	if ext == nil {
+		return Episode{}
+	}
+	return Episode{
+		Season:      strings.TrimSpace(ext.Season),
+		Episode:     strings.TrimSpace(ext.Episode),
+		EpisodeType: strings.TrimSpace(ext.EpisodeType),
+		Duration:    strings.TrimSpace(ext.Duration),
+		Explicit:    strings.TrimSpace(ext.Explicit),
+	}
+}
+
+// String describes ep in a line like "Season 2, episode 5 (bonus), 42:10".
+func (ep Episode) String() string {
+	var parts []string
+	if ep.Season != "" {
+		parts = append(parts, "season "+ep.Season)
+	}
+	if ep.Episode != "" {
+		parts = append(parts, "episode "+ep.Episode)
+	}
+	s := strings.Join(parts, ", ")
+	if ep.EpisodeType != "" && ep.EpisodeType != "full" {
+		if s == "" {
+			s = ep.EpisodeType
+		} else {
+			s += " (" + ep.EpisodeType + ")"
+		}
+	}
+	if ep.Duration != "" {
+		if s != "" {
+			s += ", "
+		}
+		s += ep.Duration
+	}
+	if r, n := utf8.DecodeRuneInString(s); n > 0 {
+		s = string(unicode.ToUpper(r)) + s[n:]
+	}
+	return s
+}
+
+// itemMedia returns HTML describing what podcast and JSON feeds often carry
+// instead of a full body: the iTunes summary if item has no body, episode
+// details, enclosures and image. It is appended to the body of the email.
+func itemMedia(item *gofeed.Item) string {
+	var b strings.Builder
+	if itemBody(item) == "" && item.ITunesExt != nil {
+		summary := item.ITunesExt.Summary
+		if summary == "" {
+			summary = item.ITunesExt.Subtitle
+		}
+		if summary != "" {
+			fmt.Fprintf(&b, "<p>%s</p>\n", html.EscapeString(summary))
+		}
+	}
+	if ep := itemEpisode(item).String(); ep != "" {
+		fmt.Fprintf(&b, "<p>%s</p>\n", html.EscapeString(ep))
+	}
+	for _, enc := range item.Enclosures {
+		if enc.URL == "" || strings.HasPrefix(enc.Type, "image/") {
+			continue
+		}
+		fmt.Fprintf(&b, "<p><a href=\"%s\">Enclosure</a>", html.EscapeString(enc.URL))
+		if enc.Type != "" {
+			fmt.Fprintf(&b, " %s", html.EscapeString(enc.Type))
+		}
+		b.WriteString("</p>\n")
+	}
+	if img := itemImage(item); img != "" && !strings.Contains(itemBody(item), img) {
+		fmt.Fprintf(&b, "<p><a href=\"%s\">Image</a></p>\n", html.EscapeString(img))
+	}
+	return b.String()
+}
@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestEpisodeString(t *testing.T) {
+	for _, tc := range []struct {
+		ep   Episode
+		want string
+	}{
+		{Episode{}, ""},
+		{Episode{Season: "2", Episode: "5", EpisodeType: "bonus", Duration: "42:10"}, "Season 2, episode 5 (bonus), 42:10"},
+		{Episode{Episode: "5", EpisodeType: "full"}, "Episode 5"},
+		{Episode{EpisodeType: "trailer"}, "Trailer"},
+		{Episode{Duration: "1:02:03"}, "1:02:03"},
+		// Capitalized by rune, not by byte
+		{Episode{EpisodeType: "épilogue"}, "Épilogue"},
+	} {
+		if got := tc.ep.String(); got != tc.want {
+			t.Errorf("%+v.String() = %q, want %q", tc.ep, got, tc.want)
+		}
+	}
+}
@@ -1,42 +1,135 @@
 package main
 
 import (
-	"errors"
+	"bufio"
+	"context"
 	"flag"
 	"fmt"
 	"os"
 	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/c-14/grue/config"
+	"github.com/mmcdole/gofeed"
 )
 
 const version = "0.3.1-next"
 
 func usage() string {
-	return `usage: grue [--help] {add|delete|fetch|import|init_cfg|list|rename} ...
+	return `usage: grue [--help] [--version] [-v] [--log-level level] {add|check-config|delete|dkim-record|edit|export|fetch|import|init_cfg|list|preview|rename|retry|serve-metrics|set|status|unset} ...
 
 Subcommands:
-	add <name> <url>
+	add [--no-check] [--init|--send n] [--force] [--name-format fmt]
+	    [--user-agent ua] [--set key=value]... <name> <url>
+	check-config
 	delete <name>
-	fetch [-init] [name]
+	dkim-record
+	edit
+	export [--tag tag]
+	fetch [-init|--dry-run [--output dir]] [--force] [--timeout duration]
+	    [--tag tag] [--report json [--report-file file]] [name|pattern]...
 	import <config>
 	init_cfg
-	list [name] [--full]
-	rename <old> <new>`
+	list [--full] [--tag tag] [name]
+	preview [--output dir] <name> [n]
+	rename <old> <new>
+	retry <name|pattern>...
+	serve-metrics [--listen address]
+	set [--account name] <key> <value>
+	status [--json] [--failing] [--stale=<age>] [name]
+	unset [--account name] <key>`
+}
+
+// settings collects repeated "key=value" flags.
+type settings []string
+
+func (s *settings) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *settings) Set(value string) error {
+	if !strings.Contains(value, "=") {
+		return fmt.Errorf("%s: expected key=value", value)
+	}
+	*s = append(*s, value)
+	return nil
 }
 
 func add(args []string, conf *config.GrueConfig) error {
-	if len(args) != 2 {
-		return errors.New("usage: grue add <name> <url>")
+	var noCheck, initFlag, force bool
+	var sendRecent int
+	var nameFormat, userAgent string
+	var sets settings
+	addCmd := flag.NewFlagSet("add", flag.ContinueOnError)
+	addCmd.BoolVar(&noCheck, "no-check", false, "Don't fetch the url to verify it is a feed")
+	addCmd.BoolVar(&initFlag, "init", false, "Mark all current entries as read")
+	addCmd.IntVar(&sendRecent, "send", -1, "Mark all but the `n` most recent entries as read")
+	addCmd.BoolVar(&force, "force", false, "Overwrite an existing account")
+	addCmd.StringVar(&nameFormat, "name-format", "", "Set the account's NameFormat")
+	addCmd.StringVar(&userAgent, "user-agent", "", "Set the account's UserAgent")
+	addCmd.Var(&sets, "set", "Set an account field as `key=value` (repeatable)")
+	if err := parseFlags(addCmd, args); err != nil {
+		return err
+	}
+	if len(addCmd.Args()) != 2 {
+		return usageErrorf("usage: grue add [--no-check] [--init|--send n] [--force] [--name-format fmt] [--user-agent ua] [--set key=value]... <name> <url>")
+	}
+	if noCheck && (initFlag || sendRecent >= 0) {
+		return usageErrorf("--no-check can't be combined with --init or --send")
+	}
+	if initFlag && sendRecent >= 0 {
+		return usageErrorf("--init and --send are mutually exclusive")
+	}
+	var name string = addCmd.Arg(0)
+	var uri string = addCmd.Arg(1)
+	if _, ok := conf.Accounts[name]; ok && !force {
+		return usageErrorf("%s: account already exists, use --force to overwrite", name)
+	}
+
+	var cfg config.AccountConfig
+	for _, kv := range sets {
+		parts := strings.SplitN(kv, "=", 2)
+		if err := cfg.Set(parts[0], parts[1]); err != nil {
+			return err
+		}
+	}
+	if nameFormat != "" {
+		cfg.NameFormat = &nameFormat
+	}
+	if userAgent != "" {
+		cfg.UserAgent = &userAgent
+	}
+
+	var feed *gofeed.Feed
+	if !noCheck {
+		feedURI, f, err := resolveFeed(uri)
+		if err != nil {
+			return err
+		}
+		if feedURI != uri {
+			fmt.Printf("Found feed %s\n", feedURI)
+			uri = feedURI
+		}
+		fmt.Printf("%s: %s (%d items)\n", name, f.Title, len(f.Items))
+		feed = f
+	}
+	cfg.URI = uri
+	if err := conf.AddAccount(name, cfg, force); err != nil {
+		return err
 	}
-	var name string = args[0]
-	var uri string = args[1]
-	return conf.AddAccount(name, uri)
+	if initFlag {
+		return InitHistory(name, feed, cfg, 0)
+	} else if sendRecent >= 0 {
+		return InitHistory(name, feed, cfg, sendRecent)
+	}
+	return nil
 }
 
 func del(args []string, conf *config.GrueConfig) error {
 	if len(args) != 1 {
-		return errors.New("usage: grue delete <name>")
+		return usageErrorf("usage: grue delete <name>")
 	}
 	name := args[0]
 	if err := conf.DeleteAccount(name); err != nil {
@@ -46,16 +139,51 @@ func del(args []string, conf *config.GrueConfig) error {
 }
 
 func fetch(args []string, conf *config.GrueConfig) error {
-	var initFlag bool
+	var opts FetchOptions
+	var timeout time.Duration
+	var tag string
 	fetchCmd := flag.NewFlagSet("fetch", flag.ContinueOnError)
-	fetchCmd.BoolVar(&initFlag, "init", false, "Don't send emails, only initialize database of read entries")
-	if err := fetchCmd.Parse(os.Args[2:]); err != nil {
+	fetchCmd.BoolVar(&opts.Init, "init", false, "Don't send emails, only initialize database of read entries")
+	fetchCmd.BoolVar(&opts.DryRun, "dry-run", false, "Print emails instead of sending them and don't update the history")
+	fetchCmd.StringVar(&opts.Output, "output", "", "With --dry-run, write emails to `directory` instead of stdout")
+	fetchCmd.StringVar(&tag, "tag", "", "Only fetch feeds tagged with `tag`")
+	fetchCmd.BoolVar(&opts.Force, "force", false, "Fetch feeds even if they are backing off after failures")
+	fetchCmd.DurationVar(&timeout, "timeout", 0, "Stop fetching after `duration` and send what was fetched so far")
+	fetchCmd.StringVar(&opts.Report, "report", "", "Print a per feed report of the run in `format` (json)")
+	fetchCmd.StringVar(&opts.ReportFile, "report-file", "", "Write the report to `file` instead of stdout, or stderr for --dry-run")
+	if err := parseFlags(fetchCmd, args); err != nil {
+		return err
+	}
+	if opts.Report != "" && opts.Report != "json" {
+		return usageErrorf("%s: unknown report format", opts.Report)
+	}
+	if opts.ReportFile != "" && opts.Report == "" {
+		return usageErrorf("--report-file requires --report")
+	}
+	if opts.Init && opts.DryRun {
+		return usageErrorf("--init and --dry-run are mutually exclusive")
+	}
+	if opts.Output != "" && !opts.DryRun {
+		return usageErrorf("--output requires --dry-run")
+	}
+	names, err := selectAccounts(conf, fetchCmd.Args(), tag)
+	if err != nil {
 		return err
 	}
-	if len(fetchCmd.Args()) == 0 {
-		return fetchFeeds(conf, initFlag)
+	ctx, cancel := signalContext(context.Background())
+	defer cancel()
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return fetchFeeds(ctx, conf, names, opts)
+}
+
+func importCfg(args []string) error {
+	if len(args) != 1 {
+		return usageErrorf("usage: grue import <config>")
 	}
-	return fetchName(conf, fetchCmd.Arg(0), initFlag)
+	return config.ImportCfg(args[0])
 }
 
 func list(args []string, conf *config.GrueConfig) error {
@@ -64,15 +192,19 @@ func list(args []string, conf *config.GrueConfig) error {
 		fmtFull  = "%s:\n%s\n"
 	)
 	var full bool
+	var tag string
 	var listCmd = flag.NewFlagSet("list", flag.ContinueOnError)
 	listCmd.BoolVar(&full, "full", false, "Show full account info")
-	if err := listCmd.Parse(args); err != nil {
+	listCmd.StringVar(&tag, "tag", "", "Only list accounts tagged with `tag`")
+	if err := parseFlags(listCmd, args); err != nil {
 		return err
 	}
 	if len(listCmd.Args()) == 0 {
 		var keys []string
-		for k := range conf.Accounts {
-			keys = append(keys, k)
+		for k, cfg := range conf.Accounts {
+			if tag == "" || cfg.HasTag(tag) {
+				keys = append(keys, k)
+			}
 		}
 		sort.Strings(keys)
 		if full {
@@ -98,9 +230,29 @@ func list(args []string, conf *config.GrueConfig) error {
 	return nil
 }
 
+func preview(args []string, conf *config.GrueConfig) error {
+	var output string
+	previewCmd := flag.NewFlagSet("preview", flag.ContinueOnError)
+	previewCmd.StringVar(&output, "output", "", "Write emails to `directory` instead of stdout")
+	if err := parseFlags(previewCmd, args); err != nil {
+		return err
+	}
+	if previewCmd.NArg() < 1 || previewCmd.NArg() > 2 {
+		return usageErrorf("usage: grue preview [--output dir] <name> [n]")
+	}
+	n := 1
+	if previewCmd.NArg() == 2 {
+		var err error
+		if n, err = strconv.Atoi(previewCmd.Arg(1)); err != nil || n < 1 {
+			return usageErrorf("%s: not a positive number", previewCmd.Arg(1))
+		}
+	}
+	return previewFeed(conf, previewCmd.Arg(0), n, output)
+}
+
 func rename(args []string, conf *config.GrueConfig) error {
 	if len(args) != 2 {
-		return errors.New("usage: grue rename <old> <new>")
+		return usageErrorf("usage: grue rename <old> <new>")
 	}
 	old := args[0]
 	new := args[1]
@@ -110,47 +262,193 @@ func rename(args []string, conf *config.GrueConfig) error {
 	return RenameHistory(old, new)
 }
 
+func retry(args []string, conf *config.GrueConfig) error {
+	if len(args) == 0 {
+		return usageErrorf("usage: grue retry <name|pattern>...")
+	}
+	names, err := selectAccounts(conf, args, "")
+	if err != nil {
+		return err
+	}
+	return RetryHistory(names)
+}
+
+func set(args []string, conf *config.GrueConfig) error {
+	var account string
+	setCmd := flag.NewFlagSet("set", flag.ContinueOnError)
+	setCmd.StringVar(&account, "account", "", "Change the setting of this account")
+	if err := parseFlags(setCmd, args); err != nil {
+		return err
+	}
+	if len(setCmd.Args()) != 2 {
+		return usageErrorf("usage: grue set [--account name] <key> <value>\n\nGlobal keys: %s\nAccount keys: %s",
+			strings.Join(config.GlobalKeys(), ", "), strings.Join(config.AccountKeys(), ", "))
+	}
+	if account != "" {
+		return conf.SetAccount(account, setCmd.Arg(0), setCmd.Arg(1))
+	}
+	return conf.SetGlobal(setCmd.Arg(0), setCmd.Arg(1))
+}
+
+func unset(args []string, conf *config.GrueConfig) error {
+	var account string
+	unsetCmd := flag.NewFlagSet("unset", flag.ContinueOnError)
+	unsetCmd.StringVar(&account, "account", "", "Change the setting of this account")
+	if err := parseFlags(unsetCmd, args); err != nil {
+		return err
+	}
+	if len(unsetCmd.Args()) != 1 {
+		return usageErrorf("usage: grue unset [--account name] <key>")
+	}
+	if account != "" {
+		return conf.UnsetAccount(account, unsetCmd.Arg(0))
+	}
+	return conf.UnsetGlobal(unsetCmd.Arg(0))
+}
+
+func edit(args []string, conf *config.GrueConfig) error {
+	if len(args) != 0 {
+		return usageErrorf("usage: grue edit")
+	}
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+	stdin := bufio.NewReader(os.Stdin)
+	return conf.Edit(editor, func(err error) bool {
+		fmt.Fprintf(os.Stderr, "Invalid config: %v\nEdit again? [Y/n] ", err)
+		answer, _ := stdin.ReadString('\n')
+		answer = strings.TrimSpace(answer)
+		return answer == "" || strings.EqualFold(answer, "y")
+	})
+}
+
+func checkConfig(args []string, conf *config.GrueConfig) error {
+	if len(args) != 0 {
+		return usageErrorf("usage: grue check-config")
+	}
+	if err := conf.Validate(); err != nil {
+		return err
+	}
+	if conf.DkimKeyFile != nil {
+		if err := checkDkim(conf); err != nil {
+			return err
+		}
+	}
+	if conf.PgpKeyring != nil {
+		if err := checkPgp(conf); err != nil {
+			return err
+		}
+	}
+	fmt.Println("config ok")
+	return nil
+}
+
 func main() {
-	if len(os.Args) < 2 {
+	var logLevel string
+	var verbose, showVersion bool
+	grueCmd := flag.NewFlagSet("grue", flag.ContinueOnError)
+	grueCmd.StringVar(&logLevel, "log-level", "", "Log `level` (debug, info, warn or error)")
+	grueCmd.BoolVar(&verbose, "v", false, "Verbose logging, same as --log-level=debug, or print the version if there is no command")
+	grueCmd.BoolVar(&showVersion, "version", false, "Print the version")
+	grueCmd.Usage = func() {
+		fmt.Fprintln(grueCmd.Output(), usage())
+		grueCmd.PrintDefaults()
+	}
+	if err := grueCmd.Parse(os.Args[1:]); err == flag.ErrHelp {
+		os.Exit(EX_OK)
+	} else if err != nil {
+		os.Exit(EX_USAGE)
+	}
+	args := grueCmd.Args()
+	// -v on its own used to print the version, keep it working
+	if showVersion || verbose && len(args) == 0 {
+		fmt.Println(version)
+		os.Exit(EX_OK)
+	}
+	if len(args) < 1 {
 		fmt.Fprintln(os.Stderr, usage())
 		os.Exit(EX_USAGE)
 	}
-	conf, err := config.ReadConfig()
+	if verbose && logLevel == "" {
+		logLevel = "debug"
+	}
+	// Fixing the config mustn't depend on it decoding strictly
+	read := config.ReadConfig
+	if args[0] == "edit" || args[0] == "check-config" {
+		read = config.ReadConfigLenient
+	}
+	conf, err := read()
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
+		switch err.(type) {
+		case *config.ConfigError, *os.PathError:
+			os.Exit(exitCode(err))
+		}
 		os.Exit(EX_TEMPFAIL)
 	}
 	defer conf.Unlock()
-	switch cmd := os.Args[1]; cmd {
+	if err = setupLogger(conf, logLevel); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		conf.Unlock()
+		os.Exit(EX_CONFIG)
+	}
+	if args[0] == "fetch" || args[0] == "preview" {
+		if err = conf.Validate(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			conf.Unlock()
+			os.Exit(EX_CONFIG)
+		}
+	}
+	switch cmd := args[0]; cmd {
 	case "add":
-		err = add(os.Args[2:], conf)
+		err = add(args[1:], conf)
+	case "check-config":
+		err = checkConfig(args[1:], conf)
 	case "delete":
-		err = del(os.Args[2:], conf)
+		err = del(args[1:], conf)
+	case "dkim-record":
+		err = dkimRecordCmd(args[1:], conf)
+	case "edit":
+		err = edit(args[1:], conf)
+	case "export":
+		err = export(args[1:], conf)
 	case "fetch":
-		err = fetch(os.Args[2:], conf)
+		err = fetch(args[1:], conf)
 	case "import":
-		err = config.ImportCfg(os.Args[2:])
+		err = importCfg(args[1:])
 	case "init_cfg":
 		break
 	case "list":
-		err = list(os.Args[2:], conf)
+		err = list(args[1:], conf)
 		break
+	case "preview":
+		err = preview(args[1:], conf)
 	case "rename":
-		err = rename(os.Args[2:], conf)
-	case "-v":
-		fallthrough
-	case "--version":
-		fmt.Println(version)
-	case "-h":
-		fallthrough
-	case "--help":
-		fmt.Println(usage())
+		err = rename(args[1:], conf)
+	case "retry":
+		err = retry(args[1:], conf)
+	case "serve-metrics":
+		err = serveMetrics(args[1:], conf)
+	case "set":
+		err = set(args[1:], conf)
+	case "status":
+		err = status(args[1:], conf)
+	case "unset":
+		err = unset(args[1:], conf)
 	default:
 		fmt.Fprintln(os.Stderr, usage())
 		conf.Unlock()
 		os.Exit(EX_USAGE)
 	}
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
+		if err != flag.ErrHelp {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		conf.Unlock()
+		os.Exit(exitCode(err))
 	}
 }
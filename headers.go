@@ -0,0 +1,65 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/c-14/grue/config"
+	"github.com/mmcdole/gofeed"
+)
+
+// headerValue folds s into a single line so feed content can't add header
+// fields of its own.
+func headerValue(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// setHeader sets the additional header name to value, replacing an earlier
+// one of the same name.
+func (email *Email) setHeader(name, value string) {
+	value = headerValue(value)
+	for i, h := range email.Headers {
+		if strings.EqualFold(h.Name, name) {
+			email.Headers[i].Value = value
+			return
+		}
+	}
+	email.Headers = append(email.Headers, Header{name, value})
+}
+
+// setHeaders sets the templated headers, in the order of their names.
+func (email *Email) setHeaders(headers map[string]string, r *strings.Replacer) {
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		email.setHeader(name, r.Replace(headers[name]))
+	}
+}
+
+// setItemHeaders sets headers describing item for filtering, followed by
+// the Headers configured globally and for the account, which may override
+// them.
+func (email *Email) setItemHeaders(feedName string, feed *gofeed.Feed, item *gofeed.Item, account config.AccountConfig, conf *config.GrueConfig) {
+	author, authorEmail := itemAuthor(feed, item, email.log)
+	if author == "" {
+		author = authorEmail
+	}
+	categories := strings.Join(itemCategories(item), ", ")
+	email.setHeader("X-RSS-Feed-Title", feed.Title)
+	email.setHeader("X-RSS-Feed-Type", feedType(feed))
+	email.setHeader("X-RSS-GUID", item.GUID)
+	email.setHeader("X-RSS-Author", author)
+	email.setHeader("X-RSS-Categories", categories)
+	email.setHeader("Keywords", categories)
+
+	r := strings.NewReplacer(append([]string{"{name}", feedName,
+		"{title}", item.Title, "{link}", item.Link, "{guid}", item.GUID,
+		"{author}", author, "{authoremail}", authorEmail,
+		"{feedtitle}", feed.Title, "{feedlink}", feed.Link},
+		extensionPlaceholders(feed, item)...)...)
+	email.setHeaders(conf.Headers, r)
+	email.setHeaders(account.Headers, r)
+}
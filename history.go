@@ -2,13 +2,19 @@ package main
 
 import (
 	"encoding/json"
+	"io/ioutil"
 	"os"
 	"path"
+	"time"
+
+	"github.com/c-14/grue/config"
+	"github.com/mmcdole/gofeed"
 )
 
 type GrueHistory struct {
-	path  string
-	Feeds map[string]*RSSFeed
+	path    string
+	LastRun *RunReport `json:",omitempty"`
+	Feeds   map[string]*RSSFeed
 }
 
 func (hist *GrueHistory) String() string {
@@ -19,15 +25,27 @@ func (hist *GrueHistory) String() string {
 	return string(b)
 }
 
+// Write replaces grue.json with hist. It writes to a temporary file first,
+// so an interrupted write leaves the previous history intact.
 func (hist *GrueHistory) Write() error {
-	file, err := os.Create(hist.path)
+	tmpfile, err := ioutil.TempFile(path.Dir(hist.path), "."+path.Base(hist.path))
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-	enc := json.NewEncoder(file)
+	enc := json.NewEncoder(tmpfile)
 	enc.SetIndent("", "  ")
-	return enc.Encode(hist)
+	err = enc.Encode(hist)
+	if cerr := tmpfile.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmpfile.Name(), 0644)
+	}
+	if err != nil {
+		os.Remove(tmpfile.Name())
+		return err
+	}
+	return os.Rename(tmpfile.Name(), hist.path)
 }
 
 func makeDefHistory() (*GrueHistory, error) {
@@ -57,13 +75,10 @@ func getHistoryPath() string {
 	return path.Join(dataPath, "grue.json")
 }
 
-func ReadHistory() (*GrueHistory, error) {
+func decodeHistory(path string) (*GrueHistory, error) {
 	var hist *GrueHistory = new(GrueHistory)
-	var path = getHistoryPath()
 	file, err := os.Open(path)
-	if os.IsNotExist(err) {
-		return writeDefHistory(path)
-	} else if err != nil {
+	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
@@ -76,6 +91,56 @@ func ReadHistory() (*GrueHistory, error) {
 	return hist, nil
 }
 
+func ReadHistory() (*GrueHistory, error) {
+	var path = getHistoryPath()
+	hist, err := decodeHistory(path)
+	if os.IsNotExist(err) {
+		return writeDefHistory(path)
+	}
+	return hist, err
+}
+
+// LoadHistory reads the history like ReadHistory, but doesn't create
+// grue.json if it is missing, for readers that don't hold the config lock
+// or must leave it alone, like dry runs.
+func LoadHistory() (*GrueHistory, error) {
+	var path = getHistoryPath()
+	hist, err := decodeHistory(path)
+	if os.IsNotExist(err) {
+		hist, err = makeDefHistory()
+		if err == nil {
+			hist.path = path
+		}
+	}
+	return hist, err
+}
+
+// InitHistory replaces the history of name with the entries of feed, all
+// marked as read except for the unread most recent ones, which will be sent
+// by the next fetch.
+func InitHistory(name string, feed *gofeed.Feed, cfg config.AccountConfig, unread int) error {
+	hist, err := ReadHistory()
+	if err != nil {
+		return err
+	}
+	account := &RSSFeed{GUIDList: make(map[string]ItemRecord)}
+	log := logger.With("feed", name, "uri", cfg.URI)
+	for i, item := range newestFirst(feed.Items, log) {
+		if i < unread {
+			continue
+		}
+		account.GUIDList[item.GUID] = newItemRecord(item, "", cfg)
+		if date, t := hasNewerDate(item, 0, log); t != NoDate && date.Unix() > account.LastFetched {
+			account.LastFetched = date.Unix()
+		}
+	}
+	if unread == 0 {
+		account.LastFetched = time.Now().Unix()
+	}
+	hist.Feeds[name] = account
+	return hist.Write()
+}
+
 func DeleteHistory(name string) error {
 	hist, err := ReadHistory()
 	if err != nil {
@@ -88,6 +153,26 @@ func DeleteHistory(name string) error {
 	return hist.Write()
 }
 
+// RetryHistory clears the backoff and failure state of the feeds called
+// names, including their alert, so they are queried on the next fetch, even
+// if they were given up on as gone.
+func RetryHistory(names []string) error {
+	hist, err := ReadHistory()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if account, ok := hist.Feeds[name]; ok {
+			account.Tries = 0
+			account.NextQuery = 0
+			account.FailingSince = 0
+			account.Alerted = false
+			account.Dead = false
+		}
+	}
+	return hist.Write()
+}
+
 func RenameHistory(old, new string) error {
 	hist, err := ReadHistory()
 	if err != nil {
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestHistoryWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	t.Setenv("XDG_DATA_HOME", dir)
+
+	hist, err := LoadHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(dir, "grue.json")); !os.IsNotExist(err) {
+		t.Fatalf("LoadHistory created grue.json: %v", err)
+	}
+
+	hist.Feeds["blog"] = &RSSFeed{LastFetched: 42}
+	if err := hist.Write(); err != nil {
+		t.Fatal(err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != "grue.json" {
+		var names []string
+		for _, f := range files {
+			names = append(names, f.Name())
+		}
+		t.Errorf("files after Write = %v, want [grue.json]", names)
+	}
+	hist, err = ReadHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if feed := hist.Feeds["blog"]; feed == nil || feed.LastFetched != 42 {
+		t.Errorf("read back %v, want LastFetched 42", feed)
+	}
+}
+
+func TestRetryHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	t.Setenv("XDG_DATA_HOME", dir)
+
+	hist, err := ReadHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hist.Feeds["broken"] = &RSSFeed{Tries: 5, NextQuery: 42, FailingSince: 23, Alerted: true, Dead: true, LastFetched: 7}
+	if err := hist.Write(); err != nil {
+		t.Fatal(err)
+	}
+	if err := RetryHistory([]string{"broken", "missing"}); err != nil {
+		t.Fatal(err)
+	}
+	if hist, err = ReadHistory(); err != nil {
+		t.Fatal(err)
+	}
+	want := RSSFeed{LastFetched: 7}
+	if got := hist.Feeds["broken"]; got == nil || !reflect.DeepEqual(*got, want) {
+		t.Errorf("after retry %+v, want %+v", got, want)
+	}
+}
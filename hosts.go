@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/c-14/grue/config"
+)
+
+// errHostLimited is returned for feeds on a host which rate limited an
+// earlier request of the same run.
+var errHostLimited = errors.New("host is rate limiting requests")
+
+// hostLimiter keeps fetches from hammering a single host by limiting the
+// number of concurrent requests to it and spacing them out.
+type hostLimiter struct {
+	mu    sync.Mutex
+	max   int
+	delay time.Duration
+	hosts map[string]*hostState
+}
+
+type hostState struct {
+	sem     chan struct{}
+	mu      sync.Mutex
+	next    time.Time
+	limited bool
+}
+
+func newHostLimiter(conf *config.GrueConfig) *hostLimiter {
+	l := &hostLimiter{hosts: make(map[string]*hostState)}
+	if conf.HostConcurrency != nil {
+		l.max = *conf.HostConcurrency
+	}
+	if conf.HostDelay != nil {
+		d, err := config.ParseAge(*conf.HostDelay)
+		if err != nil {
+			logger.Error("invalid HostDelay, not delaying requests", "error", err)
+		}
+		l.delay = d
+	}
+	return l
+}
+
+// hostOf returns the host uri is fetched from, or uri itself if it can't be
+// parsed.
+func hostOf(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Host == "" {
+		return uri
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+func (l *hostLimiter) state(host string) *hostState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	h, ok := l.hosts[host]
+	if !ok {
+		h = new(hostState)
+		if l.max > 0 {
+			h.sem = make(chan struct{}, l.max)
+		}
+		l.hosts[host] = h
+	}
+	return h
+}
+
+// acquire waits until a request to host may be made and returns a function
+// to call once it is done. It fails with errHostLimited if host rate limited
+// an earlier request, or with the context's error if ctx is done first.
+func (l *hostLimiter) acquire(ctx context.Context, host string) (func(), error) {
+	h := l.state(host)
+	if h.sem != nil {
+		select {
+		case h.sem <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	release := func() {
+		if h.sem != nil {
+			<-h.sem
+		}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.limited {
+		release()
+		return nil, errHostLimited
+	}
+	if wait := time.Until(h.next); wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			release()
+			return nil, ctx.Err()
+		}
+	}
+	h.next = time.Now().Add(l.delay)
+	return release, nil
+}
+
+// limit makes all further requests to host in this run fail with
+// errHostLimited.
+func (l *hostLimiter) limit(host string) {
+	h := l.state(host)
+	h.mu.Lock()
+	h.limited = true
+	h.mu.Unlock()
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/c-14/grue/config"
+)
+
+// hostTestServer serves an empty feed, or 429 Too Many Requests if status
+// says so, and records the times of the requests.
+type hostTestServer struct {
+	mu     sync.Mutex
+	times  []time.Time
+	status int
+}
+
+func (s *hostTestServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.times = append(s.times, time.Now())
+	s.mu.Unlock()
+	if s.status != 0 {
+		w.WriteHeader(s.status)
+		return
+	}
+	w.Write([]byte(`<rss version="2.0"><channel><title>t</title></channel></rss>`))
+}
+
+// fetchFromHost fetches n feeds on srv in a dry run with the host settings
+// in conf.
+func fetchFromHost(t *testing.T, srv *httptest.Server, n int, conf *config.GrueConfig) {
+	dir, err := ioutil.TempDir("", "grue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	t.Setenv("XDG_DATA_HOME", dir)
+
+	conf.Accounts = make(map[string]config.AccountConfig)
+	var names []string
+	for _, name := range []string{"a", "b", "c", "d"}[:n] {
+		conf.Accounts[name] = config.AccountConfig{URI: srv.URL + "/" + name}
+		names = append(names, name)
+	}
+	opts := FetchOptions{DryRun: true, Output: path.Join(dir, "mail")}
+	fetchFeeds(context.Background(), conf, names, opts)
+}
+
+func TestHostDelay(t *testing.T) {
+	s := &hostTestServer{}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	delay := "100ms"
+	fetchFromHost(t, srv, 3, &config.GrueConfig{HostDelay: &delay})
+	if len(s.times) != 3 {
+		t.Fatalf("got %d requests, want 3", len(s.times))
+	}
+	for i := 1; i < len(s.times); i++ {
+		// Allow for the clock granularity of time.After
+		if gap := s.times[i].Sub(s.times[i-1]); gap < 95*time.Millisecond {
+			t.Errorf("request %d came %v after the previous one, want at least %s", i, gap, delay)
+		}
+	}
+}
+
+func TestHostRateLimited(t *testing.T) {
+	s := &hostTestServer{status: http.StatusTooManyRequests}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	one := 1
+	fetchFromHost(t, srv, 3, &config.GrueConfig{HostConcurrency: &one})
+	if len(s.times) != 1 {
+		t.Errorf("got %d requests, want the host skipped after the first 429", len(s.times))
+	}
+}
+
+func TestHostLimiterInvalidDelay(t *testing.T) {
+	delay := "soon"
+	if l := newHostLimiter(&config.GrueConfig{HostDelay: &delay}); l.delay != 0 {
+		t.Errorf("delay = %v, want 0", l.delay)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/c-14/grue/config"
+)
+
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l LogLevel) String() string {
+	return levelNames[l]
+}
+
+func parseLogLevel(s string) (LogLevel, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return LogLevel(i), nil
+		}
+	}
+	return LevelWarn, fmt.Errorf("unknown log level %q", s)
+}
+
+// logOutput is where the lines of all Loggers derived from one another
+// end up.
+type logOutput struct {
+	mu     sync.Mutex
+	level  LogLevel
+	json   bool
+	w      io.Writer
+	syslog *syslog.Writer
+}
+
+// Logger writes leveled log lines carrying a set of key/value fields.
+type Logger struct {
+	out    *logOutput
+	fields []interface{}
+}
+
+// logger is used for all diagnostics while running commands.
+var logger = &Logger{out: &logOutput{level: LevelWarn, w: os.Stderr}}
+
+// With returns a Logger which adds the key/value pairs in fields to every
+// line.
+func (l *Logger) With(fields ...interface{}) *Logger {
+	f := make([]interface{}, 0, len(l.fields)+len(fields))
+	f = append(f, l.fields...)
+	f = append(f, fields...)
+	return &Logger{out: l.out, fields: f}
+}
+
+func (l *Logger) Debug(msg string, fields ...interface{}) {
+	l.log(LevelDebug, msg, fields)
+}
+
+func (l *Logger) Info(msg string, fields ...interface{}) {
+	l.log(LevelInfo, msg, fields)
+}
+
+func (l *Logger) Warn(msg string, fields ...interface{}) {
+	l.log(LevelWarn, msg, fields)
+}
+
+func (l *Logger) Error(msg string, fields ...interface{}) {
+	l.log(LevelError, msg, fields)
+}
+
+func logfmtValue(v interface{}) string {
+	s := fmt.Sprint(v)
+	if s == "" || strings.ContainsAny(s, " =\"\t\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func (l *Logger) log(level LogLevel, msg string, fields []interface{}) {
+	out := l.out
+	if level < out.level {
+		return
+	}
+	all := append(append([]interface{}{}, l.fields...), fields...)
+
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	if out.json {
+		line := map[string]interface{}{
+			"time":  time.Now().Format(time.RFC3339),
+			"level": level.String(),
+			"msg":   msg,
+		}
+		for i := 0; i+1 < len(all); i += 2 {
+			v := all[i+1]
+			if err, ok := v.(error); ok {
+				v = err.Error()
+			}
+			line[fmt.Sprint(all[i])] = v
+		}
+		b, _ := json.Marshal(line)
+		out.write(level, string(b))
+		return
+	}
+	var b strings.Builder
+	if out.syslog == nil {
+		fmt.Fprintf(&b, "time=%s ", time.Now().Format(time.RFC3339))
+	}
+	fmt.Fprintf(&b, "level=%s msg=%s", level, logfmtValue(msg))
+	for i := 0; i+1 < len(all); i += 2 {
+		fmt.Fprintf(&b, " %v=%s", all[i], logfmtValue(all[i+1]))
+	}
+	out.write(level, b.String())
+}
+
+func (out *logOutput) write(level LogLevel, line string) {
+	if out.syslog == nil {
+		fmt.Fprintln(out.w, line)
+		return
+	}
+	switch level {
+	case LevelDebug:
+		out.syslog.Debug(line)
+	case LevelInfo:
+		out.syslog.Info(line)
+	case LevelWarn:
+		out.syslog.Warning(line)
+	default:
+		out.syslog.Err(line)
+	}
+}
+
+// setupLogger configures logger from conf. A non-empty level overrides
+// conf.LogLevel.
+func setupLogger(conf *config.GrueConfig, level string) error {
+	out := &logOutput{level: LevelWarn, w: os.Stderr}
+	if level == "" && conf.LogLevel != nil {
+		level = *conf.LogLevel
+	}
+	if level != "" {
+		l, err := parseLogLevel(level)
+		if err != nil {
+			return err
+		}
+		out.level = l
+	}
+	if conf.LogFormat != nil {
+		switch *conf.LogFormat {
+		case "", "text":
+		case "json":
+			out.json = true
+		default:
+			return fmt.Errorf("unknown log format %q", *conf.LogFormat)
+		}
+	}
+	// A log file that can't be opened must not stop every command,
+	// including those that would fix the setting, so fall back to stderr
+	var fileErr error
+	if conf.LogFile != nil {
+		switch *conf.LogFile {
+		case "", "-":
+		case "syslog":
+			w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_MAIL, "grue")
+			if err != nil {
+				fileErr = err
+				break
+			}
+			out.syslog = w
+		default:
+			f, err := os.OpenFile(*conf.LogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+			if err != nil {
+				fileErr = err
+				break
+			}
+			out.w = f
+		}
+	}
+	logger.out = out
+	if fileErr != nil {
+		logger.Warn("can't open LogFile, logging to stderr", "file", *conf.LogFile, "error", fileErr)
+	}
+	return nil
+}
@@ -1,13 +1,20 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
 	"hash/fnv"
+	"html"
 	"io"
+	"io/ioutil"
 	"net/url"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/c-14/grue/config"
@@ -17,41 +24,81 @@ import (
 )
 
 type Email struct {
-	FromName    string
-	SenderName  string
-	FromAddress string
-	Recipient   string
-	Date        time.Time
-	Subject     string
-	UserAgent   string
-	ListId      string
-	FeedURL     string
-	ItemURI     string
-	Body        string
+	FromName      string
+	SenderAddress string
+	FromAddress   string
+	ReplyToName   string
+	ReplyTo       string
+	Recipients    []string
+	Cc            []string
+	Bcc           []string
+	Date          time.Time
+	Subject       string
+	UserAgent     string
+	ListId        string
+	FeedURL       string
+	ItemURI       string
+	MessageId     string
+	InReplyTo     string
+	Body          string
+	Diff          string
+	Headers       []Header
+	log           *Logger
+}
+
+// Header is an additional header field of an Email. Headers with an empty
+// Value are left out.
+type Header struct {
+	Name  string
+	Value string
 }
 
 func (email *Email) setFrom(feedName string, feed *gofeed.Feed, item *gofeed.Item, account config.AccountConfig, conf *config.GrueConfig) {
-	var author gofeed.Person
-	if item.Author != nil {
-		author = *item.Author
-	} else if feed.Author != nil {
-		author = *feed.Author
-	}
-	if author.Name == "" {
-		author.Name = feedName
+	authorName, authorAddress := itemAuthor(feed, item, email.log)
+	if authorName == "" {
+		authorName = feedName
 	}
-	r := strings.NewReplacer("{name}", feedName, "{title}", feed.Title,
-		"{author}", author.Name)
+	r := strings.NewReplacer(append([]string{"{name}", feedName,
+		"{title}", feed.Title, "{author}", authorName},
+		extensionPlaceholders(feed, item)...)...)
 	if account.NameFormat != nil {
 		email.FromName = r.Replace(*account.NameFormat)
 	} else {
 		email.FromName = r.Replace(conf.NameFormat)
 	}
-	if author.Email == "" {
+	switch {
+	case authorAddress == "":
 		email.FromAddress = conf.FromAddress
-	} else {
-		email.FromAddress = author.Email
-		email.SenderName = conf.FromAddress
+	case fromPolicy(account, conf) == config.FromFixed:
+		email.FromAddress = conf.FromAddress
+		email.ReplyTo = authorAddress
+		email.ReplyToName = authorName
+	default:
+		email.FromAddress = authorAddress
+		email.SenderAddress = conf.FromAddress
+	}
+}
+
+// expandAddresses replaces the {name} placeholder in addrs with feedName.
+func expandAddresses(addrs config.Addresses, feedName string) []string {
+	expanded := make([]string, len(addrs))
+	for i, addr := range addrs {
+		expanded[i] = strings.Replace(addr, "{name}", feedName, -1)
+	}
+	return expanded
+}
+
+func (email *Email) setRecipients(feedName string, account config.AccountConfig, conf *config.GrueConfig) {
+	to := conf.Recipient
+	if account.Recipient != nil {
+		to = *account.Recipient
+	}
+	email.Recipients = expandAddresses(to, feedName)
+	if account.Cc != nil {
+		email.Cc = expandAddresses(*account.Cc, feedName)
+	}
+	if account.Bcc != nil {
+		email.Bcc = expandAddresses(*account.Bcc, feedName)
 	}
 }
 
@@ -84,9 +131,19 @@ func (email *Email) setListId(feedName, feedURI string, conf *config.GrueConfig)
 	email.ListId = r.Replace(conf.ListIdFormat)
 }
 
+// Send sends email with sender. gomail.Send flattens the errors of sender
+// into strings, so those are returned as they are.
 func (email *Email) Send(sender gomail.Sender) error {
 	m := email.format()
-	return gomail.Send(sender, m)
+	var sendErr error
+	err := gomail.Send(gomail.SendFunc(func(from string, to []string, msg io.WriterTo) error {
+		sendErr = sender.Send(from, to, msg)
+		return sendErr
+	}), m)
+	if sendErr != nil {
+		return sendErr
+	}
+	return err
 }
 
 func (email *Email) format() *gomail.Message {
@@ -94,11 +151,20 @@ func (email *Email) format() *gomail.Message {
 
 	m := gomail.NewMessage()
 	m.SetAddressHeader("From", email.FromAddress, email.FromName)
-	if email.SenderName != "" {
+	if email.SenderAddress != "" {
 		// if UserAgent is "", name portion of address is omitted
-		m.SetAddressHeader("Sender", email.FromAddress, email.UserAgent)
+		m.SetAddressHeader("Sender", email.SenderAddress, email.UserAgent)
+	}
+	if email.ReplyTo != "" {
+		m.SetAddressHeader("Reply-To", email.ReplyTo, email.ReplyToName)
+	}
+	m.SetHeader("To", formatAddresses(m, email.Recipients)...)
+	if len(email.Cc) > 0 {
+		m.SetHeader("Cc", formatAddresses(m, email.Cc)...)
+	}
+	if len(email.Bcc) > 0 {
+		m.SetHeader("Bcc", formatAddresses(m, email.Bcc)...)
 	}
-	m.SetHeader("To", email.Recipient)
 	m.SetHeader("Subject", email.Subject)
 	m.SetDateHeader("Date", email.Date)
 	m.SetDateHeader("X-Date", time.Now())
@@ -109,11 +175,41 @@ func (email *Email) format() *gomail.Message {
 		m.SetHeader("List-Id", email.ListId)
 	}
 	m.SetHeader("X-RSS-Feed", email.FeedURL)
-	m.SetHeader("X-RSS-URI", email.ItemURI)
+	if email.ItemURI != "" {
+		m.SetHeader("X-RSS-URI", email.ItemURI)
+	}
+	if email.MessageId != "" {
+		m.SetHeader("Message-Id", email.MessageId)
+	}
+	if email.InReplyTo != "" {
+		m.SetHeader("In-Reply-To", email.InReplyTo)
+		m.SetHeader("References", email.InReplyTo)
+	}
+	for _, h := range email.Headers {
+		switch {
+		case h.Value == "":
+		case strings.EqualFold(h.Name, "Reply-To"):
+			if addrs := formatAddressList(m, h.Value); len(addrs) > 0 {
+				m.SetHeader("Reply-To", addrs...)
+			}
+		default:
+			m.SetHeader(h.Name, h.Value)
+		}
+	}
 	bodyPlain, err := html2text.FromString(email.Body)
 	if err != nil {
-		fmt.Printf("Failed to parse text as HTML: %v", email.Subject)
-		m.SetBody("text/html", email.Body)
+		log := email.log
+		if log == nil {
+			log = logger
+		}
+		log.Warn("failed to convert HTML body to text", "subject", email.Subject, "error", err)
+		if email.Diff != "" {
+			m.SetBody("text/html", "<pre>"+html.EscapeString(email.Diff)+"</pre>"+email.Body)
+		} else {
+			m.SetBody("text/html", email.Body)
+		}
+	} else if email.Diff != "" {
+		m.SetBody("text/plain", email.Diff+"\n"+bodyPlain)
 	} else {
 		m.SetBody("text/plain", bodyPlain)
 	}
@@ -122,26 +218,28 @@ func (email *Email) format() *gomail.Message {
 
 func createEmail(feedName string, feed *gofeed.Feed, item *gofeed.Item, date time.Time, account config.AccountConfig, conf *config.GrueConfig) *Email {
 	email := new(Email)
+	email.log = logger.With("feed", feedName, "uri", account.URI)
 	email.setFrom(feedName, feed, item, account, conf)
-	email.Recipient = conf.Recipient
+	email.setRecipients(feedName, account, conf)
 	email.Subject = item.Title
 	email.Date = date
 	email.setUserAgent(conf)
 	email.FeedURL = account.URI
 	email.ItemURI = item.Link
-	if item.Content != "" {
-		email.Body = item.Content
-	} else {
-		email.Body = item.Description
+	email.Body = itemBody(item) + itemMedia(item)
+	if trackUpdates(account) {
+		email.MessageId = makeMessageId(feedName, item, conf)
 	}
 	email.setListId(feedName, account.URI, conf)
+	email.setItemHeaders(feedName, feed, item, account, conf)
 	return email
 }
 
 type SendmailSender struct{}
 
 func (sender SendmailSender) Send(from string, to []string, msg io.WriterTo) error {
-	cmd := exec.Command("sendmail", "-oi", "-t")
+	// Pass the recipients explicitly as Bcc isn't part of msg
+	cmd := exec.Command("sendmail", append([]string{"-oi", "--"}, to...)...)
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
 		return err
@@ -208,3 +306,44 @@ func setupMailer(conf *config.GrueConfig) (gomail.Sender, error) {
 	}
 	return SendmailSender{}, nil
 }
+
+// DumpSender writes messages to a directory, one file per message, or to
+// stdout in mbox format instead of sending them.
+type DumpSender struct {
+	mu  sync.Mutex
+	dir string
+	n   int
+}
+
+func newDumpSender(dir string) (*DumpSender, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, withExit(EX_CANTCREAT, err)
+		}
+	}
+	return &DumpSender{dir: dir}, nil
+}
+
+func (sender *DumpSender) Send(from string, to []string, msg io.WriterTo) error {
+	var buf bytes.Buffer
+	if _, err := msg.WriteTo(&buf); err != nil {
+		return err
+	}
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	sender.n++
+	if sender.dir != "" {
+		name := filepath.Join(sender.dir, fmt.Sprintf("%04d.eml", sender.n))
+		return ioutil.WriteFile(name, buf.Bytes(), 0644)
+	}
+	w := bufio.NewWriter(os.Stdout)
+	fmt.Fprintf(w, "From %s %s\n", from, time.Now().UTC().Format(time.ANSIC))
+	for _, line := range strings.SplitAfter(strings.Replace(buf.String(), "\r\n", "\n", -1), "\n") {
+		if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+			w.WriteString(">")
+		}
+		w.WriteString(line)
+	}
+	w.WriteString("\n\n")
+	return w.Flush()
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/c-14/grue/config"
+)
+
+// metric is a single Prometheus metric family.
+type metric struct {
+	name  string
+	help  string
+	typ   string
+	value func(*RSSFeed) float64
+}
+
+var feedMetrics = []metric{
+	{"grue_feed_last_success_timestamp_seconds", "Time of the last successful fetch.", "gauge",
+		func(f *RSSFeed) float64 { return float64(f.LastFetched) }},
+	{"grue_feed_last_attempt_timestamp_seconds", "Time of the last fetch attempt.", "gauge",
+		func(f *RSSFeed) float64 { return float64(f.LastQueried) }},
+	{"grue_feed_consecutive_failures", "Number of consecutive failed fetches.", "gauge",
+		func(f *RSSFeed) float64 { return float64(f.Tries) }},
+	{"grue_feed_fetch_duration_seconds", "Duration of the last HTTP request.", "gauge",
+		func(f *RSSFeed) float64 { return float64(f.ResponseTime) / 1000 }},
+	{"grue_feed_http_status", "HTTP status of the last fetch, 0 if there was no response.", "gauge",
+		func(f *RSSFeed) float64 { return float64(f.HTTPStatus) }},
+	{"grue_feed_dead", "Whether the feed is gone and no longer polled.", "gauge",
+		func(f *RSSFeed) float64 { return boolValue(f.Dead) }},
+	{"grue_feed_items_delivered_total", "Emails delivered for the feed.", "counter",
+		func(f *RSSFeed) float64 { return float64(f.Delivered) }},
+	{"grue_feed_send_failures_total", "Fetches in which sending an email failed.", "counter",
+		func(f *RSSFeed) float64 { return float64(f.SendFailures) }},
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeMetrics writes the state of all configured feeds in the Prometheus
+// text exposition format.
+func writeMetrics(w io.Writer, conf *config.GrueConfig, hist *GrueHistory) error {
+	bw := bufio.NewWriter(w)
+	var names []string
+	for name := range conf.Accounts {
+		if _, ok := hist.Feeds[name]; ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, m := range feedMetrics {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.typ)
+		for _, name := range names {
+			value := strconv.FormatFloat(m.value(hist.Feeds[name]), 'f', -1, 64)
+			fmt.Fprintf(bw, "%s{feed=\"%s\"} %s\n", m.name, labelEscaper.Replace(name), value)
+		}
+	}
+	if run := hist.LastRun; run != nil {
+		fmt.Fprintf(bw, "# HELP grue_last_run_timestamp_seconds Start of the last fetch run.\n# TYPE grue_last_run_timestamp_seconds gauge\n")
+		fmt.Fprintf(bw, "grue_last_run_timestamp_seconds %d\n", run.Start)
+		fmt.Fprintf(bw, "# HELP grue_last_run_duration_seconds Duration of the last fetch run.\n# TYPE grue_last_run_duration_seconds gauge\n")
+		fmt.Fprintf(bw, "grue_last_run_duration_seconds %s\n", strconv.FormatFloat(float64(run.Duration)/1000, 'f', -1, 64))
+		fmt.Fprintf(bw, "# HELP grue_last_run_feeds Feeds by result in the last fetch run.\n# TYPE grue_last_run_feeds gauge\n")
+		for _, r := range []FetchResult{FetchOK, FetchSkipped, FetchFailed, SendFailed} {
+			var n int
+			switch r {
+			case FetchOK:
+				n = run.Queried - run.Failed - run.SendFailed
+			case FetchSkipped:
+				n = run.Skipped
+			case FetchFailed:
+				n = run.Failed
+			case SendFailed:
+				n = run.SendFailed
+			}
+			fmt.Fprintf(bw, "grue_last_run_feeds{result=\"%s\"} %d\n", r, n)
+		}
+	}
+	return bw.Flush()
+}
+
+// writeMetricsFile atomically replaces file with the current metrics, as
+// expected by the node_exporter textfile collector.
+func writeMetricsFile(file string, conf *config.GrueConfig, hist *GrueHistory) error {
+	tmpfile, err := ioutil.TempFile(path.Dir(file), "."+path.Base(file))
+	if err != nil {
+		return err
+	}
+	err = writeMetrics(tmpfile, conf, hist)
+	if cerr := tmpfile.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmpfile.Name(), 0644)
+	}
+	if err != nil {
+		os.Remove(tmpfile.Name())
+		return err
+	}
+	return os.Rename(tmpfile.Name(), file)
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	conf, err := config.LoadConfig()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	hist, err := LoadHistory()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(w, conf, hist)
+}
+
+// serveMetrics serves the metrics of the feeds over HTTP until killed. The
+// config and history are read anew on every request, so it can run
+// alongside the fetches from cron.
+func serveMetrics(args []string, conf *config.GrueConfig) error {
+	var listen string
+	serveCmd := flag.NewFlagSet("serve-metrics", flag.ContinueOnError)
+	serveCmd.StringVar(&listen, "listen", ":9110", "Listen on `address`")
+	if err := parseFlags(serveCmd, args); err != nil {
+		return err
+	}
+	if len(serveCmd.Args()) != 0 {
+		return usageErrorf("usage: grue serve-metrics [--listen address]")
+	}
+	conf.Unlock()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	logger.Info("serving metrics", "listen", listen)
+	return withExit(EX_UNAVAILABLE, http.ListenAndServe(listen, mux))
+}
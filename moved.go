@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/c-14/grue/config"
+	"github.com/mmcdole/gofeed"
+)
+
+func movedPolicy(conf *config.GrueConfig) string {
+	if conf.MovedPolicy == nil || *conf.MovedPolicy == "" {
+		return config.MovedWarn
+	}
+	return *conf.MovedPolicy
+}
+
+func isPermanentRedirect(code int) bool {
+	return code == http.StatusMovedPermanently || code == http.StatusPermanentRedirect
+}
+
+// newRedirectClient returns a client which records the target of a chain
+// of permanent redirects in account.MovedTo. A temporary redirect anywhere
+// in the chain means the feed has not moved.
+func newRedirectClient(account *RSSFeed) *http.Client {
+	permanent := true
+	return &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return fmt.Errorf("stopped after %d redirects", len(via))
+			}
+			if req.Response == nil || !isPermanentRedirect(req.Response.StatusCode) {
+				permanent = false
+			}
+			if permanent {
+				account.MovedTo = req.URL.String()
+			} else {
+				account.MovedTo = ""
+			}
+			return nil
+		},
+	}
+}
+
+// sameURI reports whether the rel="self" link a names the feed at b. Feeds
+// commonly link to themselves with another scheme or host case, so those
+// and a trailing slash are ignored. Redirects and <itunes:new-feed-url> are
+// compared exactly, as moving to https is exactly what they announce.
+func sameURI(a, b string) bool {
+	ua, errA := url.Parse(a)
+	ub, errB := url.Parse(b)
+	if errA != nil || errB != nil {
+		return strings.TrimSuffix(a, "/") == strings.TrimSuffix(b, "/")
+	}
+	return strings.EqualFold(ua.Host, ub.Host) &&
+		strings.TrimSuffix(ua.EscapedPath(), "/") == strings.TrimSuffix(ub.EscapedPath(), "/") &&
+		ua.RawQuery == ub.RawQuery
+}
+
+// feedMovedTo returns the new location announced by the feed itself
+// through <itunes:new-feed-url> or an absolute rel="self" link, or "" if
+// there is none. selfLink reports that the location is only the rel="self"
+// link, which is often stale and so never applied automatically.
+func feedMovedTo(feed *gofeed.Feed, account *RSSFeed) (uri string, selfLink bool) {
+	if feed.ITunesExt != nil && feed.ITunesExt.NewFeedURL != "" {
+		c := feed.ITunesExt.NewFeedURL
+		if isAbsURI(c) && c != account.config.URI && c != account.FinalURI {
+			return c, false
+		}
+	}
+	if c := feed.FeedLink; isAbsURI(c) && !sameURI(c, account.config.URI) && !sameURI(c, account.FinalURI) {
+		return c, true
+	}
+	return "", false
+}
+
+func isAbsURI(c string) bool {
+	u, err := url.Parse(c)
+	return err == nil && u.IsAbs()
+}
+
+// applyMoves handles the feeds found to have moved during a fetch
+// according to the configured MovedPolicy.
+func applyMoves(conf *config.GrueConfig, hist *GrueHistory) error {
+	policy := movedPolicy(conf)
+	for name, account := range hist.Feeds {
+		if account.MovedTo == "" {
+			continue
+		}
+		accountConfig, ok := conf.Accounts[name]
+		same := account.MovedTo == accountConfig.URI
+		if account.SelfLinked {
+			same = sameURI(account.MovedTo, accountConfig.URI)
+		}
+		if !ok || same {
+			account.MovedTo = ""
+			continue
+		}
+		switch {
+		case policy == config.MovedUpdate && account.SelfLinked:
+			logger.Warn("feed links to another location, not updating URI", "feed", name, "uri", accountConfig.URI, "self", account.MovedTo)
+		case policy == config.MovedUpdate:
+			if err := conf.SetAccountURI(name, account.MovedTo); err != nil {
+				return err
+			}
+			logger.Info("feed has moved, updated URI", "feed", name, "uri", accountConfig.URI, "moved_to", account.MovedTo)
+			account.MovedTo = ""
+		case policy == config.MovedWarn:
+			logger.Warn("feed has moved", "feed", name, "uri", accountConfig.URI, "moved_to", account.MovedTo)
+		case policy == config.MovedIgnore:
+		default:
+			return fmt.Errorf("MovedPolicy: unknown policy %q", policy)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/c-14/grue/config"
+	"github.com/mmcdole/gofeed"
+	ext "github.com/mmcdole/gofeed/extensions"
+)
+
+func TestSameURI(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"https://example.net/feed", "https://example.net/feed/", true},
+		{"https://example.net/feed", "http://example.net/feed", true},
+		{"https://Example.NET/feed", "https://example.net/feed", true},
+		{"https://example.net/feed", "https://example.net/Feed", false},
+		{"https://example.net/feed?a=1", "https://example.net/feed?a=2", false},
+		{"https://old.example.net/feed", "https://example.net/feed", false},
+	}
+	for _, tt := range tests {
+		if got := sameURI(tt.a, tt.b); got != tt.want {
+			t.Errorf("sameURI(%q, %q) = %t, want %t", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestFeedMovedTo(t *testing.T) {
+	account := &RSSFeed{config: config.AccountConfig{URI: "https://example.net/feed"}}
+	tests := []struct {
+		feed     gofeed.Feed
+		want     string
+		selfLink bool
+	}{
+		{gofeed.Feed{FeedLink: "http://example.net/feed"}, "", false},
+		{gofeed.Feed{FeedLink: "/feed.xml"}, "", false},
+		{gofeed.Feed{FeedLink: "https://feeds.example.com/x"}, "https://feeds.example.com/x", true},
+		{gofeed.Feed{
+			FeedLink:  "https://feeds.example.com/x",
+			ITunesExt: &ext.ITunesFeedExtension{NewFeedURL: "https://example.org/pod"},
+		}, "https://example.org/pod", false},
+		// Only self links are compared loosely
+		{gofeed.Feed{
+			ITunesExt: &ext.ITunesFeedExtension{NewFeedURL: "http://example.net/feed"},
+		}, "http://example.net/feed", false},
+	}
+	for _, tt := range tests {
+		got, selfLink := feedMovedTo(&tt.feed, account)
+		if got != tt.want || selfLink != tt.selfLink {
+			t.Errorf("feedMovedTo(%+v) = %q, %t, want %q, %t", tt.feed, got, selfLink, tt.want, tt.selfLink)
+		}
+	}
+}
+
+func TestApplyMovesRedirectToHttps(t *testing.T) {
+	warn := config.MovedWarn
+	conf := &config.GrueConfig{
+		MovedPolicy: &warn,
+		Accounts: map[string]config.AccountConfig{
+			"redirected": {URI: "http://example.net/feed"},
+			"selflinked": {URI: "http://example.net/other"},
+		},
+	}
+	hist := &GrueHistory{Feeds: map[string]*RSSFeed{
+		// A 301 from http to https is a move
+		"redirected": {MovedTo: "https://example.net/feed"},
+		// A self link that only differs in scheme is not
+		"selflinked": {MovedTo: "https://example.net/other", SelfLinked: true},
+	}}
+	if err := applyMoves(conf, hist); err != nil {
+		t.Fatal(err)
+	}
+	if got := hist.Feeds["redirected"].MovedTo; got != "https://example.net/feed" {
+		t.Errorf("redirected MovedTo = %q, want the https URI", got)
+	}
+	if got := hist.Feeds["selflinked"].MovedTo; got != "" {
+		t.Errorf("selflinked MovedTo = %q, want it cleared", got)
+	}
+}
+
+func TestRedirectClient(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/old", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/new", http.StatusMovedPermanently)
+	})
+	mux.HandleFunc("/temp", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/old", http.StatusFound)
+	})
+	mux.HandleFunc("/new", func(w http.ResponseWriter, r *http.Request) {})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	for path, want := range map[string]string{"/old": srv.URL + "/new", "/temp": "", "/new": ""} {
+		account := &RSSFeed{}
+		resp, err := newRedirectClient(account).Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if account.MovedTo != want {
+			t.Errorf("%s: MovedTo = %q, want %q", path, account.MovedTo, want)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/xml"
+	"flag"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/c-14/grue/config"
+)
+
+type opmlOutline struct {
+	Text     string         `xml:"text,attr"`
+	Type     string         `xml:"type,attr,omitempty"`
+	XMLURL   string         `xml:"xmlUrl,attr,omitempty"`
+	Category string         `xml:"category,attr,omitempty"`
+	Outlines []*opmlOutline `xml:"outline"`
+}
+
+type opmlDoc struct {
+	XMLName     xml.Name       `xml:"opml"`
+	Version     string         `xml:"version,attr"`
+	Title       string         `xml:"head>title"`
+	DateCreated string         `xml:"head>dateCreated"`
+	Outlines    []*opmlOutline `xml:"body>outline"`
+}
+
+// newOPML lists the accounts called names, grouped into an outline per
+// their first tag. All tags are kept in the category attribute.
+func newOPML(conf *config.GrueConfig, names []string) *opmlDoc {
+	doc := &opmlDoc{
+		Version:     "2.0",
+		Title:       "grue feeds",
+		DateCreated: time.Now().Format(time.RFC1123Z),
+	}
+	groups := make(map[string]*opmlOutline)
+	for _, name := range names {
+		cfg := conf.Accounts[name]
+		feed := &opmlOutline{Text: name, Type: "rss", XMLURL: cfg.URI}
+		if len(cfg.Tags) == 0 {
+			doc.Outlines = append(doc.Outlines, feed)
+			continue
+		}
+		var categories []string
+		for _, tag := range cfg.Tags {
+			categories = append(categories, "/"+tag)
+		}
+		feed.Category = strings.Join(categories, ",")
+		group, ok := groups[cfg.Tags[0]]
+		if !ok {
+			group = &opmlOutline{Text: cfg.Tags[0]}
+			groups[cfg.Tags[0]] = group
+			doc.Outlines = append(doc.Outlines, group)
+		}
+		group.Outlines = append(group.Outlines, feed)
+	}
+	sort.SliceStable(doc.Outlines, func(i, j int) bool {
+		return doc.Outlines[i].Text < doc.Outlines[j].Text
+	})
+	return doc
+}
+
+func export(args []string, conf *config.GrueConfig) error {
+	var tag string
+	exportCmd := flag.NewFlagSet("export", flag.ContinueOnError)
+	exportCmd.StringVar(&tag, "tag", "", "Only export feeds tagged with `tag`")
+	if err := parseFlags(exportCmd, args); err != nil {
+		return err
+	}
+	if exportCmd.NArg() != 0 {
+		return usageErrorf("usage: grue export [--tag tag]")
+	}
+	names, err := selectAccounts(conf, nil, tag)
+	if err != nil {
+		return err
+	}
+	os.Stdout.WriteString(xml.Header)
+	enc := xml.NewEncoder(os.Stdout)
+	enc.Indent("", "  ")
+	if err = enc.Encode(newOPML(conf, names)); err != nil {
+		return err
+	}
+	_, err = os.Stdout.WriteString("\n")
+	return err
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/c-14/grue/config"
+	"gopkg.in/gomail.v2"
+)
+
+// Hash used for signatures, named in the micalg parameter
+const (
+	pgpHash   = crypto.SHA256
+	pgpMicalg = "pgp-sha256"
+)
+
+// PgpSender signs and/or encrypts messages as PGP/MIME (RFC 3156) before
+// passing them on to another Sender. The MIME entity of the message is
+// wrapped in a multipart/signed entity, which in turn is wrapped in a
+// multipart/encrypted one. Encrypted messages are sent to every recipient
+// separately so that the key IDs in them don't give away other recipients.
+type PgpSender struct {
+	keyring    openpgp.EntityList
+	signer     *openpgp.Entity
+	sign       bool
+	encrypt    bool
+	recipients map[string]config.PgpRecipient
+	config     *packet.Config
+	sender     gomail.Sender
+}
+
+// loadKeyring reads the keys in path, which is either a binary keyring or
+// one or more ASCII armored key blocks.
+func loadKeyring(path string) (openpgp.EntityList, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Contains(data, []byte("-----BEGIN PGP")) {
+		return openpgp.ReadKeyRing(bytes.NewReader(data))
+	}
+	var keyring openpgp.EntityList
+	r := bytes.NewReader(data)
+	for {
+		block, err := armor.Decode(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys, err := openpgp.ReadKeyRing(block.Body)
+		if err != nil {
+			return nil, err
+		}
+		keyring = append(keyring, keys...)
+	}
+	if len(keyring) == 0 {
+		return nil, errors.New("no keys found")
+	}
+	return keyring, nil
+}
+
+var keyID = regexp.MustCompile(`^([0-9A-F]{16}|[0-9A-F]{40}|[0-9A-F]{64})$`)
+
+// findKey returns the first usable key in keyring matching id, which is a
+// fingerprint, a long key ID or an address. With secret only keys with
+// their private part are considered.
+func findKey(keyring openpgp.EntityList, id string, secret bool) *openpgp.Entity {
+	hexID := strings.ToUpper(strings.TrimPrefix(strings.Replace(id, " ", "", -1), "0x"))
+	if !keyID.MatchString(hexID) {
+		hexID = ""
+		if addr, err := mail.ParseAddress(id); err == nil {
+			id = addr.Address
+		}
+	}
+	now := time.Now()
+	for _, e := range keyring {
+		if secret && e.PrivateKey == nil || e.Revoked(now) {
+			continue
+		}
+		if hexID == "" {
+			for _, ident := range e.Identities {
+				if strings.EqualFold(ident.UserId.Email, id) && !ident.Revoked(now) {
+					return e
+				}
+			}
+			continue
+		}
+		keys := []*packet.PublicKey{e.PrimaryKey}
+		for _, sub := range e.Subkeys {
+			keys = append(keys, sub.PublicKey)
+		}
+		for _, k := range keys {
+			fpr := strings.ToUpper(hex.EncodeToString(k.Fingerprint))
+			if fpr == hexID || len(hexID) == 16 && strings.HasSuffix(fpr, hexID) {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+// pgpSigns reports whether conf asks for any mail to be signed.
+func pgpSigns(conf *config.GrueConfig) bool {
+	if conf.PgpSign != nil && *conf.PgpSign {
+		return true
+	}
+	for _, rcpt := range conf.PgpRecipients {
+		if rcpt.Sign != nil && *rcpt.Sign {
+			return true
+		}
+	}
+	return false
+}
+
+// loadSigner finds the signing key in keyring and unlocks it with the
+// passphrase in conf.PgpPassphraseFile if needed.
+func loadSigner(keyring openpgp.EntityList, conf *config.GrueConfig) (*openpgp.Entity, error) {
+	id := conf.FromAddress
+	if conf.PgpSigningKey != nil {
+		id = *conf.PgpSigningKey
+	}
+	signer := findKey(keyring, id, true)
+	if signer == nil {
+		return nil, fmt.Errorf("no secret key for %s", id)
+	}
+	if conf.PgpPassphraseFile != nil {
+		pass, err := ioutil.ReadFile(*conf.PgpPassphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		if err = signer.DecryptPrivateKeys(bytes.TrimRight(pass, "\r\n")); err != nil {
+			return nil, fmt.Errorf("%s: %v", id, err)
+		}
+	}
+	if key, ok := signer.SigningKey(time.Now()); !ok {
+		return nil, fmt.Errorf("%s: no valid signing key", id)
+	} else if key.PrivateKey.Encrypted {
+		return nil, fmt.Errorf("%s: secret key is protected by a passphrase, set PgpPassphraseFile", id)
+	}
+	return signer, nil
+}
+
+// newPgpSender returns a PgpSender for sender if conf has a keyring
+// configured, and sender itself otherwise.
+func newPgpSender(conf *config.GrueConfig, sender gomail.Sender) (gomail.Sender, error) {
+	if conf.PgpKeyring == nil {
+		return sender, nil
+	}
+	keyring, err := loadKeyring(*conf.PgpKeyring)
+	if err != nil {
+		return nil, withExit(EX_CONFIG, fmt.Errorf("PgpKeyring: %v", err))
+	}
+	s := &PgpSender{
+		keyring:    keyring,
+		sign:       conf.PgpSign != nil && *conf.PgpSign,
+		encrypt:    conf.PgpEncrypt != nil && *conf.PgpEncrypt,
+		recipients: make(map[string]config.PgpRecipient),
+		config:     &packet.Config{DefaultHash: pgpHash},
+		sender:     sender,
+	}
+	for addr, rcpt := range conf.PgpRecipients {
+		if a, err := mail.ParseAddress(addr); err == nil {
+			addr = a.Address
+		}
+		s.recipients[strings.ToLower(addr)] = rcpt
+	}
+	if pgpSigns(conf) {
+		if s.signer, err = loadSigner(keyring, conf); err != nil {
+			return nil, withExit(EX_CONFIG, fmt.Errorf("PgpKeyring: %v", err))
+		}
+	}
+	return s, nil
+}
+
+// policy returns whether mail to addr is signed and encrypted, and the key
+// to encrypt it to.
+func (s *PgpSender) policy(addr string) (sign, encrypt bool, key string) {
+	sign, encrypt, key = s.sign, s.encrypt, addr
+	if rcpt, ok := s.recipients[strings.ToLower(addr)]; ok {
+		if rcpt.Sign != nil {
+			sign = *rcpt.Sign
+		}
+		if rcpt.Encrypt != nil {
+			encrypt = *rcpt.Encrypt
+		}
+		if rcpt.Key != nil {
+			key = *rcpt.Key
+		}
+	}
+	return sign, encrypt, key
+}
+
+// Send wraps msg as needed for every recipient in to. Nothing is sent if it
+// can't be wrapped for one of them. All messages are built before the first
+// is sent, and a failed delivery doesn't stop the others.
+func (s *PgpSender) Send(from string, to []string, msg io.WriterTo) error {
+	var buf bytes.Buffer
+	if _, err := msg.WriteTo(&buf); err != nil {
+		return err
+	}
+	type delivery struct {
+		to  []string
+		msg []byte
+	}
+	var plain, signed []string
+	var deliveries []delivery
+	for _, addr := range to {
+		sign, encrypt, key := s.policy(addr)
+		switch {
+		case encrypt:
+			m, err := s.wrap(buf.Bytes(), sign, key)
+			if err != nil {
+				return fmt.Errorf("pgp: %s: %v", addr, err)
+			}
+			deliveries = append(deliveries, delivery{[]string{addr}, m})
+		case sign:
+			signed = append(signed, addr)
+		default:
+			plain = append(plain, addr)
+		}
+	}
+	if len(signed) > 0 {
+		m, err := s.wrap(buf.Bytes(), true, "")
+		if err != nil {
+			return fmt.Errorf("pgp: %v", err)
+		}
+		deliveries = append(deliveries, delivery{signed, m})
+	}
+	if len(plain) > 0 {
+		deliveries = append(deliveries, delivery{plain, buf.Bytes()})
+	}
+	var sent, failed []string
+	var err error
+	for _, d := range deliveries {
+		if derr := s.sender.Send(from, d.to, bytes.NewReader(d.msg)); derr != nil {
+			failed = append(failed, d.to...)
+			if err == nil {
+				err = derr
+			}
+		} else {
+			sent = append(sent, d.to...)
+		}
+	}
+	if err != nil && len(sent) > 0 {
+		return &partialSendError{sent: sent, failed: failed, err: err}
+	}
+	return err
+}
+
+// partialSendError is returned by PgpSender when a message reached some of
+// its recipients but not all.
+type partialSendError struct {
+	sent   []string
+	failed []string
+	err    error
+}
+
+func (e *partialSendError) Error() string {
+	return fmt.Sprintf("pgp: sent to %s, but not to %s: %v",
+		strings.Join(e.sent, ", "), strings.Join(e.failed, ", "), e.err)
+}
+
+// wrap moves the Content headers and body of msg into a MIME entity, signs
+// it if sign is set and encrypts it to key if that isn't empty.
+func (s *PgpSender) wrap(msg []byte, sign bool, key string) ([]byte, error) {
+	headers, body := splitMessage(msg)
+	var outer, entity bytes.Buffer
+	for _, h := range headers {
+		if strings.HasPrefix(strings.ToLower(h), "content-") {
+			entity.WriteString(h + "\r\n")
+		} else {
+			outer.WriteString(h + "\r\n")
+		}
+	}
+	entity.WriteString("\r\n")
+	entity.Write(body)
+
+	part := entity.Bytes()
+	var err error
+	if sign {
+		if part, err = s.signEntity(part); err != nil {
+			return nil, err
+		}
+	}
+	if key != "" {
+		if part, err = s.encryptEntity(part, key); err != nil {
+			return nil, err
+		}
+	}
+	outer.Write(part)
+	return outer.Bytes(), nil
+}
+
+func mimeBoundary() string {
+	b := make([]byte, 15)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// armored converts the line endings of the armor in b to CRLF.
+func armored(b []byte) []byte {
+	b = bytes.TrimRight(bytes.Replace(b, []byte("\r\n"), []byte("\n"), -1), "\n")
+	return bytes.Replace(b, []byte("\n"), []byte("\r\n"), -1)
+}
+
+// signEntity returns a multipart/signed entity containing part and its
+// detached signature, see RFC 3156 section 5.
+func (s *PgpSender) signEntity(part []byte) ([]byte, error) {
+	var sig bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&sig, s.signer, bytes.NewReader(part), s.config); err != nil {
+		return nil, err
+	}
+	boundary := mimeBoundary()
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "Content-Type: multipart/signed; boundary=\"%s\"; micalg=%s;\r\n protocol=\"application/pgp-signature\"\r\n\r\n", boundary, pgpMicalg)
+	fmt.Fprintf(&b, "--%s\r\n", boundary)
+	b.Write(part)
+	fmt.Fprintf(&b, "\r\n--%s\r\n", boundary)
+	b.WriteString("Content-Type: application/pgp-signature; name=\"signature.asc\"\r\n")
+	b.WriteString("Content-Description: OpenPGP digital signature\r\n")
+	b.WriteString("Content-Disposition: attachment; filename=\"signature.asc\"\r\n\r\n")
+	b.Write(armored(sig.Bytes()))
+	fmt.Fprintf(&b, "\r\n--%s--\r\n", boundary)
+	return b.Bytes(), nil
+}
+
+// encryptEntity returns a multipart/encrypted entity containing part
+// encrypted to key, see RFC 3156 section 4.
+func (s *PgpSender) encryptEntity(part []byte, key string) ([]byte, error) {
+	to := findKey(s.keyring, key, false)
+	if to == nil {
+		return nil, fmt.Errorf("no key for %s", key)
+	}
+	var ciphertext bytes.Buffer
+	w, err := armor.Encode(&ciphertext, "PGP MESSAGE", nil)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := openpgp.Encrypt(w, []*openpgp.Entity{to}, nil, nil, s.config)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = plaintext.Write(part); err != nil {
+		return nil, err
+	}
+	if err = plaintext.Close(); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	boundary := mimeBoundary()
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "Content-Type: multipart/encrypted; boundary=\"%s\";\r\n protocol=\"application/pgp-encrypted\"\r\n\r\n", boundary)
+	fmt.Fprintf(&b, "--%s\r\n", boundary)
+	b.WriteString("Content-Type: application/pgp-encrypted\r\n")
+	b.WriteString("Content-Description: PGP/MIME version identification\r\n\r\n")
+	b.WriteString("Version: 1\r\n")
+	fmt.Fprintf(&b, "\r\n--%s\r\n", boundary)
+	b.WriteString("Content-Type: application/octet-stream; name=\"encrypted.asc\"\r\n")
+	b.WriteString("Content-Description: OpenPGP encrypted message\r\n")
+	b.WriteString("Content-Disposition: inline; filename=\"encrypted.asc\"\r\n\r\n")
+	b.Write(armored(ciphertext.Bytes()))
+	fmt.Fprintf(&b, "\r\n--%s--\r\n", boundary)
+	return b.Bytes(), nil
+}
+
+// checkPgp makes sure the configured signing key can sign and that there
+// are keys for the configured recipients mail to whom is encrypted.
+func checkPgp(conf *config.GrueConfig) error {
+	sender, err := newPgpSender(conf, nil)
+	if err != nil {
+		return err
+	}
+	s := sender.(*PgpSender)
+	if s.signer != nil {
+		if err = openpgp.DetachSign(ioutil.Discard, s.signer, strings.NewReader("grue"), s.config); err != nil {
+			return withExit(EX_CONFIG, fmt.Errorf("PgpSigningKey: %v", err))
+		}
+	}
+	addrs := append([]string{}, conf.Recipient...)
+	if conf.AdminRecipient != nil {
+		addrs = append(addrs, *conf.AdminRecipient)
+	}
+	for addr := range conf.PgpRecipients {
+		addrs = append(addrs, addr)
+	}
+	for _, addr := range addrs {
+		if a, err := mail.ParseAddress(addr); err == nil {
+			addr = a.Address
+		}
+		if _, encrypt, key := s.policy(addr); encrypt && !strings.Contains(addr, "{") {
+			if _, err = s.encryptEntity([]byte("grue"), key); err != nil {
+				return withExit(EX_CONFIG, fmt.Errorf("PgpRecipients: %s: %v", addr, err))
+			}
+		}
+	}
+	return nil
+}
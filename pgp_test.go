@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/c-14/grue/config"
+	"gopkg.in/gomail.v2"
+)
+
+// failingPgpSender returns a PgpSender which signs mail to
+// signed@example.net, delivery of which fails, and records the recipients of
+// the other deliveries.
+func failingPgpSender(t *testing.T) (*PgpSender, *[][]string) {
+	pgpConfig := &packet.Config{Algorithm: packet.PubKeyAlgoEdDSA}
+	signer, err := openpgp.NewEntity("grue", "", "grue@example.net", pgpConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := true
+	var delivered [][]string
+	return &PgpSender{
+		signer:     signer,
+		recipients: map[string]config.PgpRecipient{"signed@example.net": {Sign: &sign}},
+		config:     pgpConfig,
+		sender: gomail.SendFunc(func(from string, to []string, msg io.WriterTo) error {
+			if to[0] == "signed@example.net" {
+				return errors.New("mailbox unavailable")
+			}
+			delivered = append(delivered, to)
+			return nil
+		}),
+	}, &delivered
+}
+
+func TestPgpSendPartial(t *testing.T) {
+	s, delivered := failingPgpSender(t)
+	msg := bytes.NewReader([]byte("Subject: test\r\nContent-Type: text/plain\r\n\r\nbody\r\n"))
+	err := s.Send("grue@example.net", []string{"signed@example.net", "plain@example.net"}, msg)
+	perr, ok := err.(*partialSendError)
+	if !ok {
+		t.Fatalf("Send() = %v, want partialSendError", err)
+	}
+	if !reflect.DeepEqual(perr.sent, []string{"plain@example.net"}) || !reflect.DeepEqual(perr.failed, []string{"signed@example.net"}) {
+		t.Errorf("sent %q, failed %q", perr.sent, perr.failed)
+	}
+	if !strings.Contains(err.Error(), "mailbox unavailable") {
+		t.Errorf("error %q doesn't name the cause", err)
+	}
+	if !reflect.DeepEqual(*delivered, [][]string{{"plain@example.net"}}) {
+		t.Errorf("delivered to %q", *delivered)
+	}
+}
+
+func TestDeliverPartial(t *testing.T) {
+	s, delivered := failingPgpSender(t)
+	e := &Email{
+		FromAddress: "grue@example.net",
+		Recipients:  []string{"signed@example.net", "plain@example.net"},
+		Subject:     "test",
+		log:         logger,
+	}
+	report := &FeedReport{}
+	// Sending it again would repeat it for plain@example.net
+	if err := deliver(e, s, report, logger); err != nil {
+		t.Errorf("deliver() = %v, want the email counted as sent", err)
+	}
+	if report.Undelivered != 1 || !strings.Contains(report.Error, "signed@example.net") {
+		t.Errorf("report = %+v, want one undelivered entry", report)
+	}
+	if len(*delivered) != 1 {
+		t.Errorf("delivered to %q", *delivered)
+	}
+}
+
+// boundaryParts returns the raw parts of the multipart entity in msg with
+// boundary, see RFC 2046 section 5.1.1.
+func boundaryParts(t *testing.T, msg []byte, boundary string) [][]byte {
+	delim := []byte("\r\n--" + boundary)
+	start := bytes.Index(msg, []byte("--"+boundary+"\r\n"))
+	end := bytes.Index(msg, []byte("\r\n--"+boundary+"--"))
+	if start < 0 || end < 0 {
+		t.Fatalf("no parts with boundary %q in:\n%s", boundary, msg)
+	}
+	var parts [][]byte
+	for _, p := range bytes.Split(msg[start+len(boundary)+4:end], delim) {
+		parts = append(parts, bytes.TrimPrefix(p, []byte("\r\n")))
+	}
+	return parts
+}
+
+var boundaryParam = regexp.MustCompile(`boundary="([^"]+)"`)
+
+func TestPgpSignEncryptRoundTrip(t *testing.T) {
+	pgpConfig := &packet.Config{Algorithm: packet.PubKeyAlgoEdDSA}
+	signer, err := openpgp.NewEntity("grue", "", "grue@example.net", pgpConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := openpgp.NewEntity("me", "", "me@example.net", pgpConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sent []byte
+	s := &PgpSender{
+		keyring: openpgp.EntityList{signer, reader},
+		signer:  signer,
+		sign:    true,
+		encrypt: true,
+		config:  pgpConfig,
+		sender: gomail.SendFunc(func(from string, to []string, msg io.WriterTo) error {
+			var buf bytes.Buffer
+			_, err := msg.WriteTo(&buf)
+			sent = buf.Bytes()
+			return err
+		}),
+	}
+	body := "Content-Type: text/plain; charset=UTF-8\r\n\r\nGrüße\r\n"
+	msg := bytes.NewReader([]byte("Subject: test\r\nTo: me@example.net\r\n" + body))
+	if err := s.Send("grue@example.net", []string{"me@example.net"}, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	headers, _ := splitMessage(sent)
+	ct, _ := lastHeader(headers, "Content-Type")
+	if !strings.Contains(ct, "multipart/encrypted") {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	if subject, _ := lastHeader(headers, "Subject"); subject != "Subject: test" {
+		t.Errorf("Subject = %q", subject)
+	}
+	parts := boundaryParts(t, sent, boundaryParam.FindStringSubmatch(ct)[1])
+	if len(parts) != 2 {
+		t.Fatalf("multipart/encrypted has %d parts, want 2", len(parts))
+	}
+	_, armoredMsg := splitMessage(parts[1])
+	block, err := armor.Decode(bytes.NewReader(armoredMsg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	md, err := openpgp.ReadMessage(block.Body, openpgp.EntityList{reader}, nil, pgpConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := ioutil.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	headers, _ = splitMessage(signed)
+	ct, _ = lastHeader(headers, "Content-Type")
+	if !strings.Contains(ct, "multipart/signed") || !strings.Contains(ct, "micalg="+pgpMicalg) {
+		t.Fatalf("inner Content-Type = %q", ct)
+	}
+	parts = boundaryParts(t, signed, boundaryParam.FindStringSubmatch(ct)[1])
+	if len(parts) != 2 {
+		t.Fatalf("multipart/signed has %d parts, want 2", len(parts))
+	}
+	if string(parts[0]) != body {
+		t.Errorf("signed part = %q, want %q", parts[0], body)
+	}
+	_, sig := splitMessage(parts[1])
+	if _, err := openpgp.CheckArmoredDetachedSignature(openpgp.EntityList{signer}, bytes.NewReader(parts[0]), bytes.NewReader(sig), pgpConfig); err != nil {
+		t.Errorf("signature: %v", err)
+	}
+}
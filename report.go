@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// FetchResult is the outcome of fetching a single feed.
+type FetchResult int
+
+const (
+	FetchOK FetchResult = iota
+	FetchSkipped
+	FetchFailed
+	SendFailed
+)
+
+var fetchResultNames = []string{"ok", "skipped", "failed", "send_failed"}
+
+func (r FetchResult) String() string {
+	return fetchResultNames[r]
+}
+
+func (r FetchResult) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// FeedReport records what happened to a single feed during a fetch run.
+type FeedReport struct {
+	Name        string
+	Result      FetchResult
+	HTTPStatus  int    `json:",omitempty"`
+	Transient   bool   `json:",omitempty"` // the fetch failed but is likely to succeed later
+	FeedType    string `json:",omitempty"` // e.g. "rss 2.0"
+	Items       int    // entries in the feed
+	Sent        int    // new entries sent
+	Updated     int    // updated entries sent again
+	Seen        int    // entries skipped as already sent
+	Undelivered int    `json:",omitempty"` // entries sent to only some recipients
+	Duration    int64  // milliseconds
+	Error       string `json:",omitempty"`
+}
+
+// RunReport summarizes a whole fetch run.
+type RunReport struct {
+	Start      int64
+	Duration   int64 // milliseconds
+	Queried    int
+	Skipped    int
+	Failed     int
+	Transient  int // failed fetches likely to succeed later
+	SendFailed int
+	Sent       int
+	Updated    int
+	Seen       int
+	Feeds      []*FeedReport `json:",omitempty"`
+}
+
+func newRunReport(start time.Time, feeds []*FeedReport) *RunReport {
+	sort.Slice(feeds, func(i, j int) bool {
+		return feeds[i].Name < feeds[j].Name
+	})
+	r := &RunReport{
+		Start:    start.Unix(),
+		Duration: int64(time.Since(start) / time.Millisecond),
+		Feeds:    feeds,
+	}
+	for _, f := range feeds {
+		switch f.Result {
+		case FetchSkipped:
+			r.Skipped++
+			continue
+		case FetchFailed:
+			r.Failed++
+			if f.Transient {
+				r.Transient++
+			}
+		case SendFailed:
+			r.SendFailed++
+		}
+		r.Queried++
+		r.Sent += f.Sent
+		r.Updated += f.Updated
+		r.Seen += f.Seen
+	}
+	return r
+}
+
+// summary returns a copy of r without the per feed reports.
+func (r *RunReport) summary() *RunReport {
+	s := *r
+	s.Feeds = nil
+	return &s
+}
+
+// finishRun logs the summary of a run, writes the report if one was
+// requested in opts, and returns the error the run should exit with.
+func finishRun(r *RunReport, opts FetchOptions) error {
+	logger.Info("fetch finished", "queried", r.Queried, "skipped", r.Skipped,
+		"failed", r.Failed, "send_failed", r.SendFailed, "sent", r.Sent,
+		"updated", r.Updated, "seen", r.Seen, "ms", r.Duration)
+	if opts.Report == "json" {
+		if err := writeReport(r, opts); err != nil {
+			return err
+		}
+	}
+	return r.err()
+}
+
+// writeReport writes r as JSON to opts.ReportFile, or to stdout unless the
+// emails of a dry run are printed there, in which case it goes to stderr.
+func writeReport(r *RunReport, opts FetchOptions) error {
+	w := os.Stdout
+	switch {
+	case opts.ReportFile != "" && opts.ReportFile != "-":
+		f, err := os.Create(opts.ReportFile)
+		if err != nil {
+			return withExit(EX_CANTCREAT, err)
+		}
+		err = encodeReport(f, r)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		return withExit(EX_IOERR, err)
+	case opts.ReportFile == "" && opts.DryRun && opts.Output == "":
+		w = os.Stderr
+	}
+	return withExit(EX_IOERR, encodeReport(w, r))
+}
+
+func encodeReport(w io.Writer, r *RunReport) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// err summarizes the results of the run as an error carrying the exit
+// code, or nil if every feed was fetched and delivered. A run in which every
+// feed failed is only temporary if one of the failures is.
+func (r *RunReport) err() error {
+	switch {
+	case r.SendFailed > 0:
+		return withExit(EX_UNAVAILABLE, fmt.Errorf("%d of %d feeds couldn't be delivered", r.SendFailed, r.Queried))
+	case r.Failed > 0 && r.Failed == r.Queried && r.Transient > 0:
+		return withExit(EX_TEMPFAIL, fmt.Errorf("all %d feeds failed", r.Failed))
+	case r.Failed > 0 && r.Failed == r.Queried:
+		return withExit(EX_UNAVAILABLE, fmt.Errorf("all %d feeds failed permanently", r.Failed))
+	case r.Failed > 0:
+		return withExit(EX_PARTIAL, fmt.Errorf("%d of %d feeds failed", r.Failed, r.Queried))
+	}
+	return nil
+}
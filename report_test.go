@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunReportErr(t *testing.T) {
+	ok := func() *FeedReport { return &FeedReport{Result: FetchOK} }
+	skipped := func() *FeedReport { return &FeedReport{Result: FetchSkipped} }
+	failed := func() *FeedReport { return &FeedReport{Result: FetchFailed} }
+	transient := func() *FeedReport { return &FeedReport{Result: FetchFailed, Transient: true} }
+	sendFailed := func() *FeedReport { return &FeedReport{Result: SendFailed} }
+	for _, tc := range []struct {
+		desc  string
+		feeds []*FeedReport
+		want  int
+	}{
+		{"ok", []*FeedReport{ok(), skipped()}, EX_OK},
+		{"nothing queried", []*FeedReport{skipped()}, EX_OK},
+		{"some failed", []*FeedReport{ok(), failed(), transient()}, EX_PARTIAL},
+		{"all transient", []*FeedReport{transient(), transient(), skipped()}, EX_TEMPFAIL},
+		{"all failed, one transient", []*FeedReport{failed(), transient()}, EX_TEMPFAIL},
+		{"all permanent", []*FeedReport{failed(), failed(), skipped()}, EX_UNAVAILABLE},
+		{"send failed", []*FeedReport{ok(), transient(), sendFailed()}, EX_UNAVAILABLE},
+	} {
+		r := newRunReport(time.Now(), tc.feeds)
+		if got := exitCode(r.err()); got != tc.want {
+			t.Errorf("%s: exit %d (%v), want %d", tc.desc, got, r.err(), tc.want)
+		}
+	}
+}
+
+func TestWriteReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stdout, err := os.Create(path.Join(dir, "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdout.Close()
+	stderr, err := os.Create(path.Join(dir, "stderr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stderr.Close()
+	oldStdout, oldStderr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = stdout, stderr
+	defer func() { os.Stdout, os.Stderr = oldStdout, oldStderr }()
+
+	r := newRunReport(time.Now(), []*FeedReport{{Name: "blog", Result: FetchOK, Sent: 2}})
+	file := path.Join(dir, "report.json")
+	for _, tc := range []struct {
+		desc string
+		opts FetchOptions
+		want string
+	}{
+		{"default", FetchOptions{}, stdout.Name()},
+		{"dry run", FetchOptions{DryRun: true}, stderr.Name()},
+		{"dry run to a directory", FetchOptions{DryRun: true, Output: dir}, stdout.Name()},
+		{"dry run to stdout", FetchOptions{DryRun: true, ReportFile: "-"}, stdout.Name()},
+		{"file", FetchOptions{DryRun: true, ReportFile: file}, file},
+	} {
+		stdout.Truncate(0)
+		stdout.Seek(0, 0)
+		stderr.Truncate(0)
+		stderr.Seek(0, 0)
+		if err := writeReport(r, tc.opts); err != nil {
+			t.Fatalf("%s: %v", tc.desc, err)
+		}
+		for _, name := range []string{stdout.Name(), stderr.Name(), file} {
+			data, _ := ioutil.ReadFile(name)
+			if name != tc.want {
+				if len(data) > 0 {
+					t.Errorf("%s: report written to %s", tc.desc, path.Base(name))
+				}
+			} else if !json.Valid(data) || !strings.Contains(string(data), `"Name": "blog"`) {
+				t.Errorf("%s: %s has %q", tc.desc, path.Base(name), data)
+			}
+		}
+		os.Remove(file)
+	}
+
+	opts := FetchOptions{ReportFile: path.Join(dir, "missing", "report.json")}
+	if err := writeReport(r, opts); exitCode(err) != EX_CANTCREAT {
+		t.Errorf("writeReport to a missing directory = %v, want EX_CANTCREAT", err)
+	}
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"math"
-	"os"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/c-14/grue/config"
@@ -14,17 +17,42 @@ import (
 type FeedFetcher struct {
 	mailer   gomail.Sender
 	init     bool
+	force    bool
+	hosts    *hostLimiter
 	sem      chan int
-	finished chan int
+	finished chan *FeedReport
+}
+
+// FetchOptions control a fetch run.
+type FetchOptions struct {
+	Init       bool   // only mark entries as read, don't send them
+	DryRun     bool   // render emails to Output instead of sending them
+	Force      bool   // fetch feeds even if they are backing off
+	Output     string // directory for DryRun, stdout if empty
+	Report     string // format of the report printed after the run
+	ReportFile string // file for the report, see writeReport
 }
 
 type RSSFeed struct {
-	config      config.AccountConfig
-	LastFetched int64               `json:",omitempty"`
-	LastQueried int64               `json:",omitempty"`
-	NextQuery   int64               `json:",omitempty"`
-	Tries       int                 `json:",omitempty"`
-	GUIDList    map[string]struct{} `json:",omitempty"`
+	config       config.AccountConfig
+	LastFetched  int64                 `json:",omitempty"`
+	LastQueried  int64                 `json:",omitempty"`
+	NextQuery    int64                 `json:",omitempty"`
+	Tries        int                   `json:",omitempty"`
+	FailingSince int64                 `json:",omitempty"`
+	Alerted      bool                  `json:",omitempty"`
+	Delivered    int64                 `json:",omitempty"`
+	SendFailures int64                 `json:",omitempty"`
+	Dead         bool                  `json:",omitempty"`
+	MovedTo      string                `json:",omitempty"`
+	SelfLinked   bool                  `json:",omitempty"` // MovedTo is only the rel="self" link
+	LastError    string                `json:",omitempty"`
+	HTTPStatus   int                   `json:",omitempty"`
+	FinalURI     string                `json:",omitempty"`
+	ContentType  string                `json:",omitempty"`
+	FeedType     string                `json:",omitempty"`
+	ResponseTime int64                 `json:",omitempty"`
+	GUIDList     map[string]ItemRecord `json:",omitempty"`
 }
 
 type DateType int
@@ -35,7 +63,7 @@ const (
 	DateOlder
 )
 
-func hasNewerDate(item *gofeed.Item, lastFetched int64) (time.Time, DateType) {
+func hasNewerDate(item *gofeed.Item, lastFetched int64, log *Logger) (time.Time, DateType) {
 	if item.PublishedParsed != nil {
 		if item.PublishedParsed.Unix() > lastFetched {
 			return *item.PublishedParsed, DateNewer
@@ -51,7 +79,7 @@ func hasNewerDate(item *gofeed.Item, lastFetched int64) (time.Time, DateType) {
 	} else if date, exists := item.Extensions["dc"]["date"]; exists {
 		dateParsed, err := time.Parse(time.RFC3339, date[0].Value)
 		if err != nil {
-			fmt.Printf("Can't parse (%v) as dc:date for (%v)\n", date, item.Link)
+			log.Warn("can't parse dc:date", "date", date[0].Value, "link", item.Link)
 			return time.Now(), NoDate
 		}
 		if dateParsed.Unix() > lastFetched {
@@ -63,123 +91,411 @@ func hasNewerDate(item *gofeed.Item, lastFetched int64) (time.Time, DateType) {
 	return time.Now(), NoDate
 }
 
-func fetchFeed(fp FeedFetcher, feedName string, account *RSSFeed, config *config.GrueConfig) {
-	// if account.UserAgent != nil {
-	// 	feed.SetUserAgent(*account.UserAgent)
-	// }
+// parseFeed fetches and parses the feed of account, recording the details
+// of the HTTP exchange in account.
+func parseFeed(ctx context.Context, parser *gofeed.Parser, account *RSSFeed) (*gofeed.Feed, error) {
+	account.HTTPStatus = 0
+	account.FinalURI = ""
+	account.ContentType = ""
+	account.ResponseTime = 0
+	account.MovedTo = ""
+	account.SelfLinked = false
+
+	req, err := http.NewRequest("GET", account.config.URI, nil)
+	if err != nil {
+		return nil, err
+	}
+	userAgent := parser.UserAgent
+	if account.config.UserAgent != nil && *account.config.UserAgent != "" {
+		userAgent = strings.Replace(*account.config.UserAgent, "{version}", version, -1)
+	}
+	req.Header.Set("User-Agent", userAgent)
+	start := time.Now()
+	resp, err := newRedirectClient(account).Do(req.WithContext(ctx))
+	account.ResponseTime = int64(time.Since(start) / time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	account.HTTPStatus = resp.StatusCode
+	account.FinalURI = resp.Request.URL.String()
+	account.ContentType = resp.Header.Get("Content-Type")
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, gofeed.HTTPError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+		}
+	}
+	return parser.Parse(resp.Body)
+}
+
+// newestFirst returns a copy of items sorted by date, newest first. Items
+// without a date are sorted last.
+func newestFirst(items []*gofeed.Item, log *Logger) []*gofeed.Item {
+	sorted := make([]*gofeed.Item, len(items))
+	copy(sorted, items)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		di, ti := hasNewerDate(sorted[i], 0, log)
+		dj, tj := hasNewerDate(sorted[j], 0, log)
+		if ti == NoDate || tj == NoDate {
+			return ti != NoDate && tj == NoDate
+		}
+		return di.After(dj)
+	})
+	return sorted
+}
+
+func fetchFeed(ctx context.Context, fp FeedFetcher, feedName string, account *RSSFeed, config *config.GrueConfig) {
+	log := logger.With("feed", feedName, "uri", account.config.URI)
 	now := time.Now()
-	if account.NextQuery > now.Unix() {
+	report := &FeedReport{Name: feedName, Result: FetchOK}
+	defer func() {
+		report.Duration = int64(time.Since(now) / time.Millisecond)
 		<-fp.sem
-		fp.finished <- 1
+		fp.finished <- report
+	}()
+	if ctx.Err() != nil {
+		log.Debug("skipping feed, fetch interrupted")
+		report.Result = FetchSkipped
+		return
+	}
+	if account.Dead || (!fp.force && account.NextQuery > now.Unix()) {
+		log.Debug("skipping feed", "dead", account.Dead, "next_query", formatTime(account.NextQuery))
+		report.Result = FetchSkipped
+		return
+	}
+	if interval := pollInterval(account.config, log); !fp.force && now.Before(time.Unix(account.LastQueried, 0).Add(interval)) {
+		log.Debug("skipping feed", "interval", interval, "last_query", formatTime(account.LastQueried))
+		report.Result = FetchSkipped
+		return
+	}
+	host := hostOf(account.config.URI)
+	release, err := fp.hosts.acquire(ctx, host)
+	if err != nil {
+		log.Info("skipping feed", "host", host, "error", err)
+		report.Result = FetchSkipped
 		return
 	}
 	parser := gofeed.NewParser()
-	feed, err := parser.ParseURL(account.config.URI)
+	feed, err := parseFeed(ctx, parser, account)
+	release()
+	if err != nil && ctx.Err() != nil {
+		log.Info("fetch interrupted", "error", err)
+		report.Result = FetchSkipped
+		return
+	}
+	if account.HTTPStatus == http.StatusTooManyRequests {
+		log.Warn("rate limited, skipping host for this run", "host", host)
+		fp.hosts.limit(host)
+	}
 	account.LastQueried = now.Unix()
+	report.HTTPStatus = account.HTTPStatus
 	if err != nil {
-		if account.Tries > 0 {
-			account.NextQuery = now.Add(time.Duration(math.Exp2(float64(account.Tries+4))) * time.Minute).Unix()
+		report.Result = FetchFailed
+		report.Error = err.Error()
+		if account.Tries == 0 {
+			account.FailingSince = now.Unix()
 		}
 		account.Tries++
-		if account.Tries > 1 {
-			fmt.Printf("Caught error (#%d) when parsing %s: %s\n", account.Tries, account.config.URI, err)
+		// Transient errors get retried on the next run before backing off
+		transient := transientError(err)
+		report.Transient = transient
+		if n := account.Tries; !transient || n > 1 {
+			if transient {
+				n--
+			}
+			account.NextQuery = now.Add(backoffPolicy(account.config, config, log).delay(n)).Unix()
+		}
+		account.LastError = err.Error()
+		account.MovedTo = ""
+		if account.HTTPStatus == http.StatusGone {
+			account.Dead = true
+			log.Warn("feed is gone, no longer polling it")
+		}
+		if account.Tries > 1 || !transient {
+			log.Warn("fetch failed", "tries", account.Tries, "transient", transient, "next_query", formatTime(account.NextQuery), "error", err)
+		} else {
+			log.Info("fetch failed", "tries", account.Tries, "transient", transient, "error", err)
+		}
+		if alertErr := checkAlert(fp.mailer, feedName, account, config, now); alertErr != nil {
+			log.Error("sending alert failed", "error", alertErr)
 		}
-		<-fp.sem
-		fp.finished <- 1
 		return
 	}
 	account.NextQuery = 0
 	account.Tries = 0
+	account.FailingSince = 0
+	account.LastError = ""
+	account.FeedType = feedType(feed)
+	if account.MovedTo == "" {
+		account.MovedTo, account.SelfLinked = feedMovedTo(feed, account)
+	}
+	if alertErr := checkAlert(fp.mailer, feedName, account, config, now); alertErr != nil {
+		log.Error("sending recovery notice failed", "error", alertErr)
+	}
+	log.Debug("fetched feed", "items", len(feed.Items), "type", account.FeedType, "status", account.HTTPStatus, "ms", account.ResponseTime)
+	report.Items = len(feed.Items)
+	report.FeedType = account.FeedType
 	guids := account.GUIDList
 	if float64(len(guids)) > 1.2*float64(len(feed.Items)) {
-		account.GUIDList = make(map[string]struct{})
+		account.GUIDList = make(map[string]ItemRecord)
 	}
+	interrupted := false
 	for _, item := range feed.Items {
 		if fp.init {
-			account.GUIDList[item.GUID] = struct{}{}
+			account.GUIDList[item.GUID] = newItemRecord(item, "", account.config)
 		} else {
-			_, exists := guids[item.GUID]
-			date, newer := hasNewerDate(item, account.LastFetched)
-			if !exists || (item.GUID == "" && newer == DateNewer) {
+			rec, exists := guids[item.GUID]
+			date, newer := hasNewerDate(item, account.LastFetched, log)
+			send := !exists || (item.GUID == "" && newer == DateNewer)
+			update := !send && trackUpdates(account.config) && rec.changed(item)
+			if (send || update) && ctx.Err() != nil {
+				// Leave the item for the next run
+				interrupted = true
+				continue
+			}
+			if send {
 				e := createEmail(feedName, feed, item, date, account.config, config)
-				err = e.Send(fp.mailer)
+				if err = deliver(e, fp.mailer, report, log); err == nil {
+					report.Sent++
+				}
+				rec = newItemRecord(item, e.MessageId, account.config)
+			} else if update {
+				e := createUpdateEmail(feedName, feed, item, rec, date, account.config, config)
+				if err = deliver(e, fp.mailer, report, log); err == nil {
+					report.Updated++
+				}
+				rec = newItemRecord(item, rec.MessageId, account.config)
+			} else {
+				report.Seen++
+				if trackUpdates(account.config) && rec.Hash == "" {
+					rec = newItemRecord(item, rec.MessageId, account.config)
+				}
 			}
 			if err == nil {
-				account.GUIDList[item.GUID] = struct{}{}
+				account.GUIDList[item.GUID] = rec
 			} else {
-				fmt.Fprintln(os.Stderr, err)
+				log.Error("sending failed", "item", item.Link, "error", err)
 				break
 			}
 		}
 	}
-	if err == nil {
+	account.Delivered += int64(report.Sent + report.Updated)
+	switch {
+	case interrupted:
+		log.Info("fetch interrupted, remaining items are sent on the next run")
+		report.Error = "interrupted"
+	case err == nil:
 		account.LastFetched = time.Now().Unix()
+	default:
+		account.SendFailures++
+		report.Result = SendFailed
+		report.Error = err.Error()
 	}
+}
 
-	<-fp.sem
-	fp.finished <- 1
+// deliver sends e. An email that reached only some of its recipients
+// counts as sent, as sending it again would repeat it for the others on
+// every run. The recipients it failed for are logged and reported.
+func deliver(e *Email, mailer gomail.Sender, report *FeedReport, log *Logger) error {
+	err := e.Send(mailer)
+	if perr, ok := err.(*partialSendError); ok {
+		log.Error("sending failed for some recipients", "subject", e.Subject,
+			"failed", strings.Join(perr.failed, ", "), "error", perr.err)
+		report.Undelivered++
+		report.Error = perr.Error()
+		return nil
+	}
+	return err
 }
 
-func fetchFeeds(conf *config.GrueConfig, init bool) error {
-	hist, err := ReadHistory()
-	if err != nil {
-		return err
+// finishFetch writes the history and metrics once all feeds of a run have
+// been fetched.
+func finishFetch(conf *config.GrueConfig, hist *GrueHistory, run *RunReport, opts FetchOptions) error {
+	if opts.DryRun {
+		return finishRun(run, opts)
+	}
+	if err := applyMoves(conf, hist); err != nil {
+		logger.Error("updating moved feeds failed", "error", err)
 	}
+	hist.LastRun = run.summary()
+	if err := hist.Write(); err != nil {
+		return withExit(EX_CANTCREAT, err)
+	}
+	if conf.MetricsFile != nil && *conf.MetricsFile != "" {
+		if err := writeMetricsFile(*conf.MetricsFile, conf, hist); err != nil {
+			logger.Error("writing metrics failed", "file", *conf.MetricsFile, "error", err)
+		}
+	}
+	return finishRun(run, opts)
+}
+
+// fetchMailer returns the mailer for a fetch run with opts.
+func fetchMailer(conf *config.GrueConfig, opts FetchOptions) (gomail.Sender, error) {
 	var mailer gomail.Sender
-	if !init {
-		mailer, err = setupMailer(conf)
-		if err != nil {
-			return err
+	var err error
+	switch {
+	case opts.Init:
+		return nil, nil
+	case opts.DryRun:
+		if mailer, err = newDumpSender(opts.Output); err != nil {
+			return nil, err
+		}
+	default:
+		if mailer, err = setupMailer(conf); err != nil {
+			return nil, withExit(EX_UNAVAILABLE, err)
+		}
+	}
+	if mailer, err = newDkimSigner(conf, mailer); err != nil {
+		return nil, err
+	}
+	return newPgpSender(conf, mailer)
+}
+
+// selectAccounts returns the sorted names of the accounts in conf matching
+// any of patterns, which are account names or shell globs. All accounts are
+// selected if there are no patterns. A non-empty tag restricts the selection
+// to the accounts with that tag.
+func selectAccounts(conf *config.GrueConfig, patterns []string, tag string) ([]string, error) {
+	var names []string
+	if len(patterns) == 0 {
+		for name := range conf.Accounts {
+			names = append(names, name)
+		}
+	}
+	selected := make(map[string]bool)
+	for _, pattern := range patterns {
+		if _, ok := conf.Accounts[pattern]; ok {
+			if !selected[pattern] {
+				selected[pattern] = true
+				names = append(names, pattern)
+			}
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, usageErrorf("%s: %v", pattern, err)
 		}
+		matched := false
+		for name := range conf.Accounts {
+			if ok, _ := path.Match(pattern, name); ok {
+				matched = true
+				if !selected[name] {
+					selected[name] = true
+					names = append(names, name)
+				}
+			}
+		}
+		if !matched {
+			return nil, usageErrorf("%s: no matching account", pattern)
+		}
+	}
+	if tag != "" {
+		var tagged []string
+		for _, name := range names {
+			if conf.Accounts[name].HasTag(tag) {
+				tagged = append(tagged, name)
+			}
+		}
+		if len(tagged) == 0 {
+			return nil, usageErrorf("%s: no matching account with this tag", tag)
+		}
+		names = tagged
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// fetchFeeds fetches the accounts called names and records the result in
+// the history.
+func fetchFeeds(ctx context.Context, conf *config.GrueConfig, names []string, opts FetchOptions) error {
+	start := time.Now()
+	readHistory := ReadHistory
+	if opts.DryRun {
+		// A dry run mustn't even create grue.json
+		readHistory = LoadHistory
+	}
+	hist, err := readHistory()
+	if err != nil {
+		return err
+	}
+	mailer, err := fetchMailer(conf, opts)
+	if err != nil {
+		return err
 	}
 
-	fp := FeedFetcher{init: init, mailer: mailer, sem: make(chan int, 10), finished: make(chan int)}
+	concurrency := 10
+	if conf.Concurrency != nil {
+		concurrency = *conf.Concurrency
+	}
+	fp := FeedFetcher{
+		init:     opts.Init,
+		force:    opts.Force,
+		mailer:   mailer,
+		hosts:    newHostLimiter(conf),
+		sem:      make(chan int, concurrency),
+		finished: make(chan *FeedReport),
+	}
 	go func() {
-		for name, accountConfig := range conf.Accounts {
+		for _, name := range names {
 			fp.sem <- 1
 			account, exist := hist.Feeds[name]
 			if !exist {
 				account = new(RSSFeed)
-				account.GUIDList = make(map[string]struct{})
 				hist.Feeds[name] = account
-			} else if len(account.GUIDList) == 0 {
-				account.GUIDList = make(map[string]struct{})
 			}
-			account.config = accountConfig
-			go fetchFeed(fp, name, account, conf)
+			if len(account.GUIDList) == 0 {
+				account.GUIDList = make(map[string]ItemRecord)
+			}
+			account.config, _ = conf.Account(name)
+			go fetchFeed(ctx, fp, name, account, conf)
 		}
 	}()
-	for range conf.Accounts {
-		<-fp.finished
+	var reports []*FeedReport
+	for range names {
+		reports = append(reports, <-fp.finished)
 	}
-	return hist.Write()
+	run := newRunReport(start, reports)
+	err = finishFetch(conf, hist, run, opts)
+	if ctx.Err() != nil && exitCode(err) != EX_CANTCREAT {
+		return withExit(EX_TEMPFAIL, fmt.Errorf("fetch interrupted: %v", ctx.Err()))
+	}
+	return err
 }
 
-func fetchName(conf *config.GrueConfig, name string, init bool) error {
-	accountConfig, ok := conf.Accounts[name]
+// previewFeed fetches the account called name and renders emails for its n
+// newest items without looking at or changing the history.
+func previewFeed(conf *config.GrueConfig, name string, n int, output string) error {
+	cfg, ok := conf.Account(name)
 	if !ok {
-		return fmt.Errorf("%s: account does not exist", name)
+		return usageErrorf("%s: account does not exist", name)
 	}
-	hist, err := ReadHistory()
+	dump, err := newDumpSender(output)
 	if err != nil {
 		return err
 	}
-	fp := FeedFetcher{
-		init:     init,
-		sem:      make(chan int, 1),
-		finished: make(chan int),
-	}
-	fp.sem <- 1
-	account, exist := hist.Feeds[name]
-	if !exist {
-		account = new(RSSFeed)
-		hist.Feeds[name] = account
-	}
-	if len(account.GUIDList) == 0 {
-		account.GUIDList = make(map[string]struct{})
-	}
-	account.config = accountConfig
-	go fetchFeed(fp, name, account, conf)
-	<-fp.finished
-	return hist.Write()
+	mailer, err := newDkimSigner(conf, dump)
+	if err != nil {
+		return err
+	}
+	if mailer, err = newPgpSender(conf, mailer); err != nil {
+		return err
+	}
+	account := &RSSFeed{config: cfg}
+	parser := gofeed.NewParser()
+	feed, err := parseFeed(context.Background(), parser, account)
+	if err != nil {
+		return withExit(exitCode(err), fmt.Errorf("%s: %v", name, err))
+	}
+	log := logger.With("feed", name, "uri", cfg.URI)
+	items := newestFirst(feed.Items, log)
+	if n < len(items) {
+		items = items[:n]
+	}
+	for _, item := range items {
+		date, _ := hasNewerDate(item, 0, log)
+		if err = createEmail(name, feed, item, date, cfg, conf).Send(mailer); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/c-14/grue/config"
+)
+
+func TestSelectAccounts(t *testing.T) {
+	conf := &config.GrueConfig{Accounts: map[string]config.AccountConfig{
+		"blog-a": {Tags: []string{"news"}},
+		"blog-b": {},
+		"comic":  {Tags: []string{"fun", "news"}},
+		"blog-*": {},
+	}}
+	for _, tc := range []struct {
+		patterns []string
+		tag      string
+		want     []string
+	}{
+		{nil, "", []string{"blog-*", "blog-a", "blog-b", "comic"}},
+		{[]string{"comic", "blog-a"}, "", []string{"blog-a", "comic"}},
+		{[]string{"blog-?"}, "", []string{"blog-*", "blog-a", "blog-b"}},
+		// An account name is taken literally, not as a glob
+		{[]string{"blog-*"}, "", []string{"blog-*"}},
+		{[]string{"blog-[ab]", "blog-a"}, "", []string{"blog-a", "blog-b"}},
+		{nil, "news", []string{"blog-a", "comic"}},
+		{[]string{"blog-?"}, "news", []string{"blog-a"}},
+	} {
+		got, err := selectAccounts(conf, tc.patterns, tc.tag)
+		if err != nil {
+			t.Errorf("selectAccounts(%q, %q): %v", tc.patterns, tc.tag, err)
+		} else if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("selectAccounts(%q, %q) = %q, want %q", tc.patterns, tc.tag, got, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		patterns []string
+		tag      string
+	}{
+		{[]string{"missing"}, ""},
+		{[]string{"blog-["}, ""},
+		{[]string{"blog-b"}, "news"},
+		{nil, "none"},
+	} {
+		if _, err := selectAccounts(conf, tc.patterns, tc.tag); exitCode(err) != EX_USAGE {
+			t.Errorf("selectAccounts(%q, %q) = %v, want usage error", tc.patterns, tc.tag, err)
+		}
+	}
+}
+
+func TestDryRunLeavesHistoryAlone(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	t.Setenv("XDG_DATA_HOME", dir)
+
+	conf := &config.GrueConfig{Accounts: map[string]config.AccountConfig{}}
+	opts := FetchOptions{DryRun: true, Output: path.Join(dir, "mail")}
+	if err := fetchFeeds(context.Background(), conf, nil, opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(dir, "grue.json")); !os.IsNotExist(err) {
+		t.Errorf("dry run created grue.json: %v", err)
+	}
+}
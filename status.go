@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/c-14/grue/config"
+)
+
+// FeedStatus summarizes the health of a single feed as recorded in the
+// history.
+type FeedStatus struct {
+	Name         string
+	URI          string
+	LastFetched  int64 `json:",omitempty"`
+	LastQueried  int64 `json:",omitempty"`
+	NextQuery    int64 `json:",omitempty"`
+	Failures     int
+	LastError    string `json:",omitempty"`
+	Items        int
+	Dead         bool   `json:",omitempty"`
+	MovedTo      string `json:",omitempty"`
+	HTTPStatus   int    `json:",omitempty"`
+	FinalURI     string `json:",omitempty"`
+	ContentType  string `json:",omitempty"`
+	FeedType     string `json:",omitempty"`
+	ResponseTime int64  `json:",omitempty"`
+}
+
+// problem describes what is wrong with the feed, if anything.
+func (st FeedStatus) problem() string {
+	var problems []string
+	if st.Dead {
+		problems = append(problems, "gone")
+	}
+	if st.MovedTo != "" {
+		problems = append(problems, "moved to "+st.MovedTo)
+	}
+	if st.LastError != "" {
+		problems = append(problems, st.LastError)
+	}
+	return strings.Join(problems, "; ")
+}
+
+func newFeedStatus(name string, account config.AccountConfig, feed *RSSFeed) FeedStatus {
+	st := FeedStatus{Name: name, URI: account.URI}
+	if feed == nil {
+		return st
+	}
+	st.LastFetched = feed.LastFetched
+	st.LastQueried = feed.LastQueried
+	st.NextQuery = feed.NextQuery
+	st.Failures = feed.Tries
+	st.LastError = feed.LastError
+	st.Items = len(feed.GUIDList)
+	st.Dead = feed.Dead
+	st.MovedTo = feed.MovedTo
+	st.HTTPStatus = feed.HTTPStatus
+	st.FinalURI = feed.FinalURI
+	st.ContentType = feed.ContentType
+	st.FeedType = feed.FeedType
+	st.ResponseTime = feed.ResponseTime
+	return st
+}
+
+func formatTime(t int64) string {
+	if t == 0 {
+		return "never"
+	}
+	return time.Unix(t, 0).Format("2006-01-02 15:04")
+}
+
+func printStatusTable(statuses []FeedStatus) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tLAST SUCCESS\tLAST ATTEMPT\tFAILURES\tNEXT QUERY\tITEMS\tHTTP\tERROR")
+	for _, st := range statuses {
+		next := "-"
+		if st.NextQuery != 0 {
+			next = formatTime(st.NextQuery)
+		}
+		httpStatus := "-"
+		if st.HTTPStatus != 0 {
+			httpStatus = strconv.Itoa(st.HTTPStatus)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%d\t%s\t%s\n", st.Name,
+			formatTime(st.LastFetched), formatTime(st.LastQueried),
+			st.Failures, next, st.Items, httpStatus, st.problem())
+	}
+	return w.Flush()
+}
+
+func status(args []string, conf *config.GrueConfig) error {
+	var jsonFlag, failing bool
+	var staleFlag string
+	statusCmd := flag.NewFlagSet("status", flag.ContinueOnError)
+	statusCmd.BoolVar(&jsonFlag, "json", false, "Print status as JSON")
+	statusCmd.BoolVar(&failing, "failing", false, "Only show feeds whose last query failed")
+	statusCmd.StringVar(&staleFlag, "stale", "", "Only show feeds without a successful fetch in this long (e.g. 30d)")
+	if err := parseFlags(statusCmd, args); err != nil {
+		return err
+	}
+	if len(statusCmd.Args()) > 1 {
+		return usageErrorf("usage: grue status [--json] [--failing] [--stale=<age>] [name]")
+	}
+	var stale time.Duration
+	if staleFlag != "" {
+		var err error
+		if stale, err = config.ParseAge(staleFlag); err != nil {
+			return withExit(EX_USAGE, err)
+		}
+	}
+
+	hist, err := ReadHistory()
+	if err != nil {
+		return err
+	}
+	var names []string
+	if len(statusCmd.Args()) == 1 {
+		name := statusCmd.Arg(0)
+		if _, ok := conf.Accounts[name]; !ok {
+			return usageErrorf("%s: account does not exist", name)
+		}
+		names = append(names, name)
+	} else {
+		for k := range conf.Accounts {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+	}
+
+	now := time.Now()
+	statuses := []FeedStatus{}
+	for _, name := range names {
+		cfg, _ := conf.Account(name)
+		st := newFeedStatus(name, cfg, hist.Feeds[name])
+		if failing && st.Failures == 0 {
+			continue
+		}
+		if stale != 0 && st.LastFetched > now.Add(-stale).Unix() {
+			continue
+		}
+		statuses = append(statuses, st)
+	}
+
+	if jsonFlag {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(statuses)
+	}
+	return printStatusTable(statuses)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/c-14/grue/config"
+	"github.com/jaytaylor/html2text"
+	"github.com/mmcdole/gofeed"
+)
+
+// ItemRecord is what grue remembers about an item it has already seen.
+// Unless update tracking is enabled for the account all fields are
+// empty, so the history stays as small as a plain list of GUIDs.
+type ItemRecord struct {
+	Hash      string `json:",omitempty"`
+	Updated   int64  `json:",omitempty"`
+	MessageId string `json:",omitempty"`
+	Text      string `json:",omitempty"`
+}
+
+func trackUpdates(account config.AccountConfig) bool {
+	return account.TrackUpdates != nil && *account.TrackUpdates
+}
+
+func updateDiff(account config.AccountConfig) bool {
+	return account.UpdateDiff != nil && *account.UpdateDiff
+}
+
+func itemBody(item *gofeed.Item) string {
+	if item.Content != "" {
+		return item.Content
+	}
+	return item.Description
+}
+
+func itemUpdated(item *gofeed.Item) int64 {
+	if item.UpdatedParsed != nil {
+		return item.UpdatedParsed.Unix()
+	}
+	return 0
+}
+
+func itemHash(item *gofeed.Item) string {
+	return hash(item.Title + "\x00" + item.Link + "\x00" + itemBody(item))
+}
+
+func itemText(item *gofeed.Item) string {
+	text, err := html2text.FromString(itemBody(item))
+	if err != nil {
+		return itemBody(item)
+	}
+	return text
+}
+
+// newItemRecord creates the record stored in the history for item. The
+// messageId is that of the email sent for the item, if any.
+func newItemRecord(item *gofeed.Item, messageId string, account config.AccountConfig) ItemRecord {
+	var rec ItemRecord
+	if !trackUpdates(account) {
+		return rec
+	}
+	rec.Hash = itemHash(item)
+	rec.Updated = itemUpdated(item)
+	rec.MessageId = messageId
+	if updateDiff(account) {
+		rec.Text = itemText(item)
+	}
+	return rec
+}
+
+// changed reports whether item differs from the version that was
+// recorded. Records without a hash predate update tracking and are never
+// considered changed.
+func (rec ItemRecord) changed(item *gofeed.Item) bool {
+	if rec.Hash == "" {
+		return false
+	}
+	if updated := itemUpdated(item); updated != 0 && rec.Updated != 0 && updated != rec.Updated {
+		return true
+	}
+	return rec.Hash != itemHash(item)
+}
+
+// makeMessageId creates a unique Message-Id for an email about item so
+// that later updates can be threaded to it.
+func makeMessageId(feedName string, item *gofeed.Item, conf *config.GrueConfig) string {
+	domain := "grue"
+	if i := strings.LastIndex(conf.FromAddress, "@"); i >= 0 && i < len(conf.FromAddress)-1 {
+		domain = conf.FromAddress[i+1:]
+	}
+	return fmt.Sprintf("<%d.%s.%s@%s>", time.Now().UnixNano(), hash(feedName), hash(item.GUID), domain)
+}
+
+func createUpdateEmail(feedName string, feed *gofeed.Feed, item *gofeed.Item, rec ItemRecord, date time.Time, account config.AccountConfig, conf *config.GrueConfig) *Email {
+	email := createEmail(feedName, feed, item, date, account, conf)
+	email.Subject = "Updated: " + item.Title
+	email.MessageId = makeMessageId(feedName, item, conf)
+	email.InReplyTo = rec.MessageId
+	if updateDiff(account) && rec.Text != "" {
+		email.Diff = diffLines(rec.Text, itemText(item))
+		if email.Diff == "" {
+			email.log.Info("item changed too much to include a diff", "item", item.Link)
+		}
+	}
+	return email
+}
+
+// maxDiffCells limits the size of the table diffLines needs, which grows
+// with the product of the numbers of changed lines.
+const maxDiffCells = 1 << 20
+
+// diffLines returns a line based diff between prev and cur in which removed
+// lines are prefixed with "-", added lines with "+" and unchanged lines
+// with a space. It returns "" if the texts differ in too many lines to diff
+// them cheaply.
+func diffLines(prev, cur string) string {
+	x := strings.Split(prev, "\n")
+	y := strings.Split(cur, "\n")
+
+	// Lines shared at the start and end don't need the table
+	var head, tail int
+	for head < len(x) && head < len(y) && x[head] == y[head] {
+		head++
+	}
+	for tail < len(x)-head && tail < len(y)-head && x[len(x)-1-tail] == y[len(y)-1-tail] {
+		tail++
+	}
+	common := x[:head]
+	trailing := x[len(x)-tail:]
+	x, y = x[head:len(x)-tail], y[head:len(y)-tail]
+	if (len(x)+1)*(len(y)+1) > maxDiffCells {
+		return ""
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of
+	// x[i:] and y[j:].
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var b strings.Builder
+	for _, line := range common {
+		fmt.Fprintf(&b, " %s\n", line)
+	}
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			fmt.Fprintf(&b, " %s\n", x[i])
+			i++
+			j++
+		case j < len(y) && (i == len(x) || lcs[i][j+1] > lcs[i+1][j]):
+			fmt.Fprintf(&b, "+%s\n", y[j])
+			j++
+		default:
+			fmt.Fprintf(&b, "-%s\n", x[i])
+			i++
+		}
+	}
+	for _, line := range trailing {
+		fmt.Fprintf(&b, " %s\n", line)
+	}
+	return b.String()
+}
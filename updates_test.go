@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		prev, cur, want string
+	}{
+		{"a\nb\nc", "a\nb\nc", " a\n b\n c\n"},
+		{"a\nb\nc", "a\nx\nc", " a\n-b\n+x\n c\n"},
+		{"a\nb", "a\nb\nc", " a\n b\n+c\n"},
+		{"a\nb\nc", "b\nc", "-a\n b\n c\n"},
+		{"", "a", "-\n+a\n"},
+	}
+	for _, tt := range tests {
+		if got := diffLines(tt.prev, tt.cur); got != tt.want {
+			t.Errorf("diffLines(%q, %q) = %q, want %q", tt.prev, tt.cur, got, tt.want)
+		}
+	}
+}
+
+func TestDiffLinesTooLarge(t *testing.T) {
+	var prev, cur []string
+	for i := 0; i < 5000; i++ {
+		prev = append(prev, "old "+strings.Repeat("x", i%7))
+		cur = append(cur, "new "+strings.Repeat("y", i%5))
+	}
+	if got := diffLines(strings.Join(prev, "\n"), strings.Join(cur, "\n")); got != "" {
+		t.Errorf("diffLines of 5000 changed lines = %d bytes, want none", len(got))
+	}
+
+	// Long texts with a small change are still diffed
+	changed := append([]string{}, prev...)
+	changed[2500] = "changed"
+	got := diffLines(strings.Join(prev, "\n"), strings.Join(changed, "\n"))
+	if !strings.Contains(got, "\n+changed\n") || strings.Count(got, "\n") != 5001 {
+		t.Errorf("diffLines of one changed line in 5000 lines = %d lines", strings.Count(got, "\n"))
+	}
+}